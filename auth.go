@@ -0,0 +1,338 @@
+package lndurl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+const (
+	// TagLogin is the tag used in LNURL-auth URLs.
+	TagLogin = "login"
+
+	// authChallengeExpiry is how long a wallet has to sign a k1 challenge
+	// once it has been issued.
+	authChallengeExpiry = 10 * time.Minute
+
+	// authSessionExpiry is how long an authenticated session is kept, so
+	// that the web app can pick up its linking key.
+	authSessionExpiry = time.Hour
+
+	// maxAuthSessions is the max number of sessions, authenticated or
+	// not, that are kept at the same time.
+	maxAuthSessions = 10000
+)
+
+var (
+	// ErrInvalidAuthSignature is returned when a signature does not
+	// verify against the given k1 and linking key.
+	ErrInvalidAuthSignature = errors.New("invalid signature")
+
+	// ErrTooManyAuthChallenges is returned if no more challenges can be
+	// issued until existing sessions have expired.
+	ErrTooManyAuthChallenges = errors.New("too many auth sessions, " +
+		"try again later")
+)
+
+// AuthChallenge is a k1 challenge issued by the server along with the LNURL
+// that a wallet must visit in order to answer it.
+type AuthChallenge struct {
+	// K1 is the hex encoded 32 byte challenge that the wallet must sign.
+	K1 string `json:"k1"`
+
+	// LNURL is the bech32 encoded LNURL-auth URL.
+	LNURL string `json:"lnurl"`
+}
+
+// AuthStatus describes the state of an LNURL-auth session.
+type AuthStatus struct {
+	// K1 is the challenge identifying the session.
+	K1 string `json:"k1"`
+
+	// Authenticated is true once a wallet has signed the challenge.
+	Authenticated bool `json:"authenticated"`
+
+	// Key is the hex encoded linking key of the wallet that signed the
+	// challenge.
+	Key string `json:"key,omitempty"`
+}
+
+// authSession tracks a single k1 challenge and the linking key that answered
+// it, if any.
+type authSession struct {
+	k1         string
+	createdAt  time.Time
+	linkingKey string
+	authedAt   time.Time
+}
+
+// authSessions holds the set of issued LNURL-auth challenges.
+type authSessions struct {
+	sessions map[string]*authSession
+
+	// keys maps a linking key to the k1s of all sessions that it has
+	// authenticated.
+	keys map[string][]string
+
+	mu sync.Mutex
+}
+
+func newAuthSessions() *authSessions {
+	return &authSessions{
+		sessions: make(map[string]*authSession),
+		keys:     make(map[string][]string),
+	}
+}
+
+// reap removes the sessions whose challenge expired without being answered
+// and the authenticated sessions that expired by the given time. The number of
+// removed sessions is returned.
+func (a *authSessions) reap(now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var n int
+	for k1, session := range a.sessions {
+		expiry := session.createdAt.Add(authChallengeExpiry)
+		if session.linkingKey != "" {
+			expiry = session.authedAt.Add(authSessionExpiry)
+		}
+
+		if now.Before(expiry) {
+			continue
+		}
+
+		delete(a.sessions, k1)
+		n++
+
+		if session.linkingKey != "" {
+			a.removeKeySession(session.linkingKey, k1)
+		}
+	}
+
+	return n
+}
+
+// removeKeySession removes the session identified by k1 from the sessions of
+// the given linking key. It must be called with mu held.
+func (a *authSessions) removeKeySession(linkingKey, k1 string) {
+	k1s := a.keys[linkingKey]
+	for i := range k1s {
+		if k1s[i] == k1 {
+			k1s = append(k1s[:i], k1s[i+1:]...)
+			break
+		}
+	}
+
+	if len(k1s) == 0 {
+		delete(a.keys, linkingKey)
+		return
+	}
+	a.keys[linkingKey] = k1s
+}
+
+// VerifyAuthSignature checks that sig is a valid DER encoded secp256k1
+// signature over k1 by the given linking key. All arguments are expected to
+// be hex encoded. The parsed linking key is returned on success.
+func VerifyAuthSignature(k1, sig, key string) (*btcec.PublicKey, error) {
+	k1Bytes, err := hex.DecodeString(k1)
+	if err != nil || len(k1Bytes) != 32 {
+		return nil, fmt.Errorf("k1 must be 32 hex encoded bytes")
+	}
+
+	sigBytes, err := hex.DecodeString(sig)
+	if err != nil {
+		return nil, fmt.Errorf("sig is not hex encoded: %w", err)
+	}
+
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex encoded: %w", err)
+	}
+
+	pubKey, err := btcec.ParsePubKey(keyBytes, btcec.S256())
+	if err != nil {
+		return nil, fmt.Errorf("invalid linking key: %w", err)
+	}
+
+	signature, err := btcec.ParseDERSignature(sigBytes, btcec.S256())
+	if err != nil {
+		return nil, fmt.Errorf("invalid DER signature: %w", err)
+	}
+
+	if !signature.Verify(k1Bytes, pubKey) {
+		return nil, ErrInvalidAuthSignature
+	}
+
+	return pubKey, nil
+}
+
+// NewAuthChallenge issues a new k1 challenge and returns it along with the
+// LNURL that a wallet can use to answer it. ErrTooManyAuthChallenges is
+// returned if too many sessions exist.
+func (s *Server) NewAuthChallenge() (*AuthChallenge, error) {
+	var k1 [32]byte
+	if _, err := rand.Read(k1[:]); err != nil {
+		return nil, err
+	}
+
+	session := &authSession{
+		k1:        hex.EncodeToString(k1[:]),
+		createdAt: time.Now(),
+	}
+
+	lnurl, err := EncodeURL(fmt.Sprintf(
+		"%s://%s:%d/auth?tag=%s&k1=%s&action=login", s.cfg.Protocol,
+		s.cfg.Host, s.cfg.Port, TagLogin, session.k1,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+
+	if len(s.auth.sessions) >= maxAuthSessions {
+		return nil, ErrTooManyAuthChallenges
+	}
+	s.auth.sessions[session.k1] = session
+
+	return &AuthChallenge{
+		K1:    session.k1,
+		LNURL: lnurl,
+	}, nil
+}
+
+// AuthLinkingKey returns the hex encoded linking key that authenticated the
+// session identified by k1. False is returned if the session is unknown, has
+// not been authenticated yet or has expired. Authenticated sessions expire an
+// hour after they were authenticated.
+func (s *Server) AuthLinkingKey(k1 string) (string, bool) {
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+
+	session, ok := s.auth.sessions[k1]
+	if !ok || session.linkingKey == "" {
+		return "", false
+	}
+
+	return session.linkingKey, true
+}
+
+// AuthSessions returns the k1s of all sessions that have been authenticated
+// by the given hex encoded linking key and that haven't expired yet.
+func (s *Server) AuthSessions(key string) []string {
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+
+	return append([]string(nil), s.auth.keys[key]...)
+}
+
+// authChallenge issues a new k1 challenge. It allows web apps to implement
+// "login with Lightning" by displaying the returned LNURL and then polling
+// authStatus.
+func (s *Server) authChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge, err := s.NewAuthChallenge()
+	switch {
+	case errors.Is(err, ErrTooManyAuthChallenges):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, challenge)
+}
+
+// authStatus reports whether the session identified by the k1 parameter has
+// been authenticated and by which linking key.
+func (s *Server) authStatus(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	k1 := r.Form.Get("k1")
+
+	s.auth.mu.Lock()
+	session, ok := s.auth.sessions[k1]
+	if !ok {
+		s.auth.mu.Unlock()
+		writeError(w, http.StatusNotFound, "unknown k1")
+		return
+	}
+	status := &AuthStatus{
+		K1:            session.k1,
+		Authenticated: session.linkingKey != "",
+		Key:           session.linkingKey,
+	}
+	s.auth.mu.Unlock()
+
+	writeJSON(w, status)
+}
+
+// authCallback is called by LN WALLET with its linking key and a signature
+// over k1.
+func (s *Server) authCallback(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if tag := r.Form.Get("tag"); tag != TagLogin {
+		writeError(
+			w, http.StatusBadRequest,
+			fmt.Sprintf("unsupported tag '%s'", tag),
+		)
+		return
+	}
+
+	k1, sig, key := r.Form.Get("k1"), r.Form.Get("sig"), r.Form.Get("key")
+	if k1 == "" || sig == "" || key == "" {
+		writeError(
+			w, http.StatusBadRequest,
+			"expected 'k1', 'sig' and 'key' fields",
+		)
+		return
+	}
+
+	pubKey, err := VerifyAuthSignature(k1, sig, key)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	linkingKey := hex.EncodeToString(pubKey.SerializeCompressed())
+
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+
+	session, ok := s.auth.sessions[k1]
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, "unknown k1")
+		return
+
+	case time.Since(session.createdAt) > authChallengeExpiry:
+		delete(s.auth.sessions, k1)
+		writeError(w, http.StatusBadRequest, "k1 has expired")
+		return
+
+	case session.linkingKey != "":
+		writeError(w, http.StatusBadRequest, "k1 has already been used")
+		return
+	}
+
+	session.linkingKey = linkingKey
+	session.authedAt = time.Now()
+	s.auth.keys[linkingKey] = append(s.auth.keys[linkingKey], k1)
+
+	writeJSON(w, &StatusResponse{Status: StatusOK})
+}
@@ -0,0 +1,213 @@
+package lndurl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAuthSignature(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+
+	var k1 [32]byte
+	_, err = rand.Read(k1[:])
+	require.NoError(t, err)
+
+	sig, err := priv.Sign(k1[:])
+	require.NoError(t, err)
+
+	k1Hex := hex.EncodeToString(k1[:])
+	sigHex := hex.EncodeToString(sig.Serialize())
+	keyHex := hex.EncodeToString(priv.PubKey().SerializeCompressed())
+
+	pubKey, err := VerifyAuthSignature(k1Hex, sigHex, keyHex)
+	require.NoError(t, err)
+	require.True(t, pubKey.IsEqual(priv.PubKey()))
+
+	// A signature by a different key must not verify.
+	other, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	otherKey := hex.EncodeToString(other.PubKey().SerializeCompressed())
+
+	_, err = VerifyAuthSignature(k1Hex, sigHex, otherKey)
+	require.ErrorIs(t, err, ErrInvalidAuthSignature)
+
+	// Neither may a signature over a different k1.
+	k1[0] ^= 1
+	_, err = VerifyAuthSignature(hex.EncodeToString(k1[:]), sigHex, keyHex)
+	require.ErrorIs(t, err, ErrInvalidAuthSignature)
+
+	// Malformed inputs are rejected.
+	_, err = VerifyAuthSignature("abcd", sigHex, keyHex)
+	require.Error(t, err)
+
+	_, err = VerifyAuthSignature(k1Hex, "zz", keyHex)
+	require.Error(t, err)
+}
+
+// signAuth answers the given auth challenge with the linking key priv, as
+// LN WALLET would.
+func signAuth(t *testing.T, priv *btcec.PrivateKey, k1 string) url.Values {
+	k1Bytes, err := hex.DecodeString(k1)
+	require.NoError(t, err)
+
+	sig, err := priv.Sign(k1Bytes)
+	require.NoError(t, err)
+
+	key := priv.PubKey().SerializeCompressed()
+
+	return url.Values{
+		"tag": {TagLogin},
+		"k1":  {k1},
+		"sig": {hex.EncodeToString(sig.Serialize())},
+		"key": {hex.EncodeToString(key)},
+	}
+}
+
+// TestAuthFlow tests issuing a challenge, answering it and polling its
+// status.
+func TestAuthFlow(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	var challenge AuthChallenge
+	code := s.get(t, "/auth/challenge", nil, &challenge)
+	require.Equal(t, http.StatusOK, code)
+
+	authURL, err := DecodeURL(challenge.LNURL)
+	require.NoError(t, err)
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	require.Equal(t, "/auth", u.Path)
+	require.Equal(t, TagLogin, u.Query().Get("tag"))
+	require.Equal(t, challenge.K1, u.Query().Get("k1"))
+
+	var status AuthStatus
+	code = s.get(t, "/auth/status", url.Values{"k1": {challenge.K1}},
+		&status)
+	require.Equal(t, http.StatusOK, code)
+	require.False(t, status.Authenticated)
+
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	query := signAuth(t, priv, challenge.K1)
+
+	// A signature by the wrong key or with the wrong tag is rejected.
+	other, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	badQuery := signAuth(t, other, challenge.K1)
+	badQuery.Set("key", query.Get("key"))
+
+	var errResp Error
+	code = s.get(t, "/auth", badQuery, &errResp)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	badQuery = signAuth(t, priv, challenge.K1)
+	badQuery.Set("tag", "withdrawRequest")
+	code = s.get(t, "/auth", badQuery, &errResp)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	var statusResp StatusResponse
+	code = s.get(t, "/auth", query, &statusResp)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, StatusOK, statusResp.Status)
+
+	code = s.get(t, "/auth/status", url.Values{"k1": {challenge.K1}},
+		&status)
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, status.Authenticated)
+	require.Equal(t, query.Get("key"), status.Key)
+	require.Equal(
+		t, []string{challenge.K1}, s.AuthSessions(query.Get("key")),
+	)
+
+	// A challenge can only be answered once.
+	code = s.get(t, "/auth", query, &errResp)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Unknown challenges are rejected.
+	var unknown [32]byte
+	query = signAuth(t, priv, hex.EncodeToString(unknown[:]))
+	code = s.get(t, "/auth", query, &errResp)
+	require.Equal(t, http.StatusNotFound, code)
+
+	code = s.get(t, "/auth/status", url.Values{"k1": {query.Get("k1")}},
+		&errResp)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+// TestAuthSessionLimits tests that expired challenges and sessions are reaped
+// along with their linking keys and that no more challenges are issued while
+// too many sessions exist.
+func TestAuthSessionLimits(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	expired, err := s.NewAuthChallenge()
+	require.NoError(t, err)
+	answered, err := s.NewAuthChallenge()
+	require.NoError(t, err)
+
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	key := hex.EncodeToString(priv.PubKey().SerializeCompressed())
+
+	var statusResp StatusResponse
+	code := s.get(t, "/auth", signAuth(t, priv, answered.K1), &statusResp)
+	require.Equal(t, http.StatusOK, code)
+
+	// The challenge that wasn't answered is reaped once it expires.
+	now := time.Now()
+	require.Equal(t, 0, s.auth.reap(now.Add(time.Minute)))
+	require.Equal(t, 1, s.auth.reap(now.Add(authChallengeExpiry)))
+
+	var errResp Error
+	code = s.get(t, "/auth/status", url.Values{"k1": {expired.K1}},
+		&errResp)
+	require.Equal(t, http.StatusNotFound, code)
+
+	_, ok := s.AuthLinkingKey(answered.K1)
+	require.True(t, ok)
+	require.Equal(t, []string{answered.K1}, s.AuthSessions(key))
+
+	// The authenticated session and its linking key are reaped later.
+	require.Equal(t, 1, s.auth.reap(now.Add(authSessionExpiry+time.Minute)))
+
+	_, ok = s.AuthLinkingKey(answered.K1)
+	require.False(t, ok)
+	require.Empty(t, s.AuthSessions(key))
+	require.Empty(t, s.auth.keys)
+
+	// Fill up the sessions. Answering a challenge doesn't make room for
+	// new ones, only expiring sessions do.
+	var pending []*AuthChallenge
+	for i := 0; i < maxAuthSessions; i++ {
+		challenge, err := s.NewAuthChallenge()
+		require.NoError(t, err)
+		pending = append(pending, challenge)
+	}
+
+	code = s.get(t, "/auth/challenge", nil, &errResp)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, StatusError, errResp.Status)
+
+	code = s.get(t, "/auth", signAuth(t, priv, pending[0].K1), &statusResp)
+	require.Equal(t, http.StatusOK, code)
+
+	code = s.get(t, "/auth/challenge", nil, &errResp)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+
+	require.Equal(
+		t, maxAuthSessions,
+		s.auth.reap(time.Now().Add(authSessionExpiry+time.Minute)),
+	)
+
+	var challenge AuthChallenge
+	code = s.get(t, "/auth/challenge", nil, &challenge)
+	require.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,116 @@
+package lndurl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+// Backend is the Lightning node that the server creates invoices on and pays
+// withdrawals from.
+type Backend interface {
+	// AddInvoice creates an invoice that commits to the given description
+	// hash and returns its payment hash and payment request.
+	AddInvoice(ctx context.Context, req *InvoiceRequest) (lntypes.Hash,
+		string, error)
+
+	// SubscribeInvoices sends an update every time one of the node's
+	// invoices is settled, starting from the time of the call. Other
+	// updates may be sent as well. Updates that happened while not
+	// subscribed must be looked up with LookupInvoice. The subscription
+	// is closed once the context is cancelled.
+	SubscribeInvoices(ctx context.Context) (<-chan InvoiceUpdate,
+		<-chan error, error)
+
+	// LookupInvoice returns the current state of the given invoice.
+	LookupInvoice(ctx context.Context, hash lntypes.Hash) (*InvoiceUpdate,
+		error)
+
+	// PayInvoice pays the given payment request, spending at most
+	// maxFeeMsat on routing fees. It blocks until the payment succeeded
+	// or failed. If the payment definitely failed, a PaymentFailedError
+	// is returned. Any other error means that the outcome is unknown.
+	PayInvoice(ctx context.Context, pr string, maxFeeMsat int64) (
+		*PaymentResult, error)
+
+	// NodeInfo returns information about the node.
+	NodeInfo(ctx context.Context) (*NodeInfo, error)
+
+	// Close releases the connection to the node.
+	Close() error
+}
+
+// PaymentFailedError is returned by PayInvoice if a payment definitely
+// failed, so that no funds have left the node and none will.
+type PaymentFailedError struct {
+	Err error
+}
+
+// Error returns the reason that the payment failed for.
+func (e *PaymentFailedError) Error() string {
+	return fmt.Sprintf("payment failed: %v", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *PaymentFailedError) Unwrap() error {
+	return e.Err
+}
+
+// InvoiceRequest holds the parameters of an invoice to create.
+type InvoiceRequest struct {
+	// Memo is a human readable note. Backends that can't combine a memo
+	// with a description hash ignore it.
+	Memo string
+
+	// Preimage is the preimage of the invoice. It is picked by the server
+	// so that it can be used to encrypt the success action.
+	Preimage lntypes.Preimage
+
+	// AmountMsat is the amount of the invoice.
+	AmountMsat int64
+
+	// Description is the LNURL metadata, possibly followed by payer data,
+	// that the invoice commits to. Backends that hash the description
+	// themselves use it instead of DescriptionHash.
+	Description string
+
+	// DescriptionHash is the SHA256 hash of Description.
+	DescriptionHash [32]byte
+
+	// Expiry is how long the invoice can be paid for.
+	Expiry time.Duration
+}
+
+// InvoiceUpdate reports the state of an invoice.
+type InvoiceUpdate struct {
+	// Hash is the payment hash of the invoice.
+	Hash lntypes.Hash
+
+	// State is InvoiceStateIssued while the invoice can still be paid.
+	// Backends that can't tell apart expired and cancelled invoices
+	// report InvoiceStateCancelled for both.
+	State InvoiceState
+
+	// AmountPaidMsat is the amount paid to a settled invoice.
+	AmountPaidMsat int64
+}
+
+// PaymentResult describes a successful payment.
+type PaymentResult struct {
+	Preimage lntypes.Preimage
+	FeeMsat  int64
+}
+
+// NodeInfo holds information about the backend's node.
+type NodeInfo struct {
+	Alias  string
+	PubKey string
+
+	// Network is the network that the node runs on, named like
+	// lndclient.Network.
+	Network string
+
+	BlockHeight uint32
+}
@@ -0,0 +1,380 @@
+package lndurl
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// metadataBucket holds the metadata handed out to payers, keyed by
+	// callback id.
+	metadataBucket = []byte("metadata")
+
+	// invoicesBucket holds the issued invoices, keyed by payment hash.
+	invoicesBucket = []byte("invoices")
+
+	// ledgerBucket holds a sub-bucket per user with their ledger entries,
+	// keyed by payment hash.
+	ledgerBucket = []byte("ledger")
+
+	// withdrawBucket holds the withdraw links and their remaining
+	// budgets, keyed by k1.
+	withdrawBucket = []byte("withdraw")
+)
+
+// BoltStore is a Store backed by a bbolt database file.
+type BoltStore struct {
+	// numMetadata is the number of entries in the metadata bucket. It
+	// must be used atomically. It is counted when the store is opened
+	// and kept up to date afterwards so that NumMetadata doesn't have to
+	// walk the bucket.
+	numMetadata int64
+
+	// addMetadataMu serialises AddMetadata so that the number of entries
+	// can't change between checking it and adding an entry. Removing
+	// entries only lowers the number, so it doesn't need to be held.
+	addMetadataMu sync.Mutex
+
+	db *bbolt.DB
+}
+
+// A compile time check to ensure that BoltStore implements Store.
+var _ Store = (*BoltStore)(nil)
+
+// NewBoltStore opens (or creates) the bbolt database at the given path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not open database %s: %w", path,
+			err)
+	}
+
+	var numMetadata int
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{
+			metadataBucket, invoicesBucket, ledgerBucket,
+			withdrawBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		numMetadata = tx.Bucket(metadataBucket).Stats().KeyN
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{
+		numMetadata: int64(numMetadata),
+		db:          db,
+	}, nil
+}
+
+// AddMetadata stores metadata that was handed out to a payer unless max
+// entries are already outstanding.
+func (b *BoltStore) AddMetadata(meta *Metadata, max int) error {
+	b.addMetadataMu.Lock()
+	defer b.addMetadataMu.Unlock()
+
+	var added bool
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metadataBucket)
+		added = bucket.Get([]byte(meta.ID)) == nil
+
+		n := atomic.LoadInt64(&b.numMetadata)
+		if added && max > 0 && n >= int64(max) {
+			return ErrMetadataFull
+		}
+
+		return putJSON(bucket, []byte(meta.ID), meta)
+	})
+	if err != nil {
+		return err
+	}
+
+	if added {
+		atomic.AddInt64(&b.numMetadata, 1)
+	}
+
+	return nil
+}
+
+// FetchMetadata returns the metadata with the given id.
+func (b *BoltStore) FetchMetadata(id string) (*Metadata, error) {
+	var meta Metadata
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(metadataBucket).Get([]byte(id))
+		if v == nil {
+			return ErrMetadataNotFound
+		}
+
+		return json.Unmarshal(v, &meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// PopMetadata atomically fetches and removes the metadata with the given id.
+func (b *BoltStore) PopMetadata(id string) (*Metadata, error) {
+	var meta Metadata
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metadataBucket)
+
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return ErrMetadataNotFound
+		}
+
+		if err := json.Unmarshal(v, &meta); err != nil {
+			return err
+		}
+
+		return bucket.Delete([]byte(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&b.numMetadata, -1)
+
+	return &meta, nil
+}
+
+// DeleteExpiredMetadata removes all metadata that was created before the
+// given time.
+func (b *BoltStore) DeleteExpiredMetadata(before time.Time) (int, error) {
+	var n int
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metadataBucket)
+
+		// Collect the keys first since the bucket may not be modified
+		// while iterating over it.
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var meta Metadata
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+
+			if meta.CreatedAt.Before(before) {
+				expired = append(expired, k)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&b.numMetadata, -int64(n))
+
+	return n, nil
+}
+
+// NumMetadata returns the number of outstanding metadata entries.
+func (b *BoltStore) NumMetadata() (int, error) {
+	return int(atomic.LoadInt64(&b.numMetadata)), nil
+}
+
+// AddInvoice stores a newly issued invoice.
+func (b *BoltStore) AddInvoice(inv *Invoice) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(invoicesBucket), inv.Hash[:], inv)
+	})
+}
+
+// FetchInvoice returns the invoice with the given payment hash.
+func (b *BoltStore) FetchInvoice(hash lntypes.Hash) (*Invoice, error) {
+	var inv Invoice
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(invoicesBucket).Get(hash[:])
+		if v == nil {
+			return ErrInvoiceNotFound
+		}
+
+		return json.Unmarshal(v, &inv)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &inv, nil
+}
+
+// UpdateInvoiceState updates the state of the invoice with the given payment
+// hash.
+func (b *BoltStore) UpdateInvoiceState(hash lntypes.Hash, state InvoiceState,
+	at time.Time) error {
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(invoicesBucket)
+
+		v := bucket.Get(hash[:])
+		if v == nil {
+			return ErrInvoiceNotFound
+		}
+
+		var inv Invoice
+		if err := json.Unmarshal(v, &inv); err != nil {
+			return err
+		}
+
+		inv.State = state
+		if state == InvoiceStateSettled {
+			inv.SettledAt = at
+		}
+
+		return putJSON(bucket, hash[:], &inv)
+	})
+}
+
+// ListInvoices returns all stored invoices ordered by creation time.
+func (b *BoltStore) ListInvoices() ([]*Invoice, error) {
+	var invoices []*Invoice
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(invoicesBucket).ForEach(func(_, v []byte) error {
+			var inv Invoice
+			if err := json.Unmarshal(v, &inv); err != nil {
+				return err
+			}
+			invoices = append(invoices, &inv)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(invoices, func(i, j int) bool {
+		return invoices[i].CreatedAt.Before(invoices[j].CreatedAt)
+	})
+
+	return invoices, nil
+}
+
+// AddLedgerEntry records an entry in a user's ledger.
+func (b *BoltStore) AddLedgerEntry(entry *LedgerEntry) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		userBucket, err := tx.Bucket(ledgerBucket).CreateBucketIfNotExists(
+			[]byte(entry.Username),
+		)
+		if err != nil {
+			return err
+		}
+
+		if userBucket.Get(entry.Hash[:]) != nil {
+			return ErrDuplicateLedgerEntry
+		}
+
+		return putJSON(userBucket, entry.Hash[:], entry)
+	})
+}
+
+// LedgerEntries returns all ledger entries of the given user ordered by time.
+func (b *BoltStore) LedgerEntries(username string) ([]*LedgerEntry, error) {
+	var entries []*LedgerEntry
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		userBucket := tx.Bucket(ledgerBucket).Bucket([]byte(username))
+		if userBucket == nil {
+			return nil
+		}
+
+		return userBucket.ForEach(func(_, v []byte) error {
+			var entry LedgerEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, &entry)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+
+	return entries, nil
+}
+
+// PutWithdrawLink stores the given withdraw link, replacing any link with the
+// same k1.
+func (b *BoltStore) PutWithdrawLink(link *WithdrawLink) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(withdrawBucket), []byte(link.K1), link)
+	})
+}
+
+// ListWithdrawLinks returns all stored withdraw links ordered by creation
+// time.
+func (b *BoltStore) ListWithdrawLinks() ([]*WithdrawLink, error) {
+	var links []*WithdrawLink
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(withdrawBucket)
+
+		return bucket.ForEach(func(_, v []byte) error {
+			var link WithdrawLink
+			if err := json.Unmarshal(v, &link); err != nil {
+				return err
+			}
+			links = append(links, &link)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.Before(links[j].CreatedAt)
+	})
+
+	return links, nil
+}
+
+// Close closes the underlying database.
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// putJSON serialises v and stores it under the given key.
+func putJSON(bucket *bbolt.Bucket, key []byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, b)
+}
@@ -0,0 +1,164 @@
+package lndurl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrMetadataExpired is returned if a callback is called after its metadata
+// has expired.
+var ErrMetadataExpired = errors.New("metadata expired")
+
+const (
+	// callbackMetaHashLen is the number of bytes of the metadata hash
+	// that a callback token commits to.
+	callbackMetaHashLen = 8
+
+	// callbackPayloadLen is the length of a token payload without the
+	// username.
+	callbackPayloadLen = 8 + callbackMetaHashLen
+
+	// minCallbackSecretLen is the min length of Config.CallbackSecret.
+	minCallbackSecretLen = 32
+)
+
+// stateless returns true if callback ids are self-contained tokens instead of
+// references to metadata in the store.
+func (s *Server) stateless() bool {
+	return s.cfg.CallbackSecret != ""
+}
+
+// signedMetadata builds the metadata for a pay request to the given user in
+// stateless mode and returns it along with the raw metadata string. Its id is
+// a token that commits to the user, the expiry and the metadata, so that any
+// server sharing the callback secret can serve the callback.
+func (s *Server) signedMetadata(user *User) (*Metadata, string, error) {
+	meta := &Metadata{
+		Fallback:  s.stableDescription(user),
+		CreatedAt: time.Now(),
+	}
+	if user != nil {
+		meta.Username = user.Username
+	}
+
+	data, err := s.userMetadata(user, meta.Fallback)
+	if err != nil {
+		return nil, "", err
+	}
+	meta.Hash = sha256.Sum256([]byte(data))
+
+	expiry := meta.CreatedAt.Add(s.cfg.MetadataExpiry)
+	meta.ID = s.callbackToken(meta.Username, data, expiry)
+
+	return meta, data, nil
+}
+
+// parseSignedMetadata checks the given callback token and rebuilds the
+// metadata and the raw metadata string that it was handed out with.
+// ErrMetadataNotFound is returned for invalid tokens and ErrMetadataExpired
+// for expired tokens or if the user's metadata has changed since.
+func (s *Server) parseSignedMetadata(id string) (*Metadata, string, error) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 2 {
+		return nil, "", ErrMetadataNotFound
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) < callbackPayloadLen {
+		return nil, "", ErrMetadataNotFound
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, s.callbackMAC(payload)) {
+		return nil, "", ErrMetadataNotFound
+	}
+
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(payload[:8])), 0)
+	metaHash := payload[8:callbackPayloadLen]
+	username := string(payload[callbackPayloadLen:])
+
+	if !time.Now().Before(expiry) {
+		return nil, "", ErrMetadataExpired
+	}
+
+	var user *User
+	if username != "" {
+		user, err = s.users.LookupUser(username)
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, "", ErrMetadataNotFound
+		} else if err != nil {
+			return nil, "", err
+		}
+	}
+
+	fallback := s.stableDescription(user)
+	data, err := s.userMetadata(user, fallback)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The wallet checks the invoice against the metadata that it was
+	// handed, so it must not have changed since.
+	if !bytes.Equal(metadataHash(data), metaHash) {
+		return nil, "", ErrMetadataExpired
+	}
+
+	return &Metadata{
+		ID:        id,
+		Hash:      sha256.Sum256([]byte(data)),
+		Fallback:  fallback,
+		Username:  username,
+		CreatedAt: expiry.Add(-s.cfg.MetadataExpiry),
+	}, data, nil
+}
+
+// callbackToken creates a callback id for the given user and metadata that is
+// valid until expiry. It is of the form <payload>.<mac>, both base64url
+// encoded.
+func (s *Server) callbackToken(username, data string,
+	expiry time.Time) string {
+
+	payload := make([]byte, callbackPayloadLen, callbackPayloadLen+
+		len(username))
+	binary.BigEndian.PutUint64(payload[:8], uint64(expiry.Unix()))
+	copy(payload[8:callbackPayloadLen], metadataHash(data))
+	payload = append(payload, username...)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(s.callbackMAC(payload))
+}
+
+// callbackMAC authenticates the given token payload with the callback
+// secret.
+func (s *Server) callbackMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(s.cfg.CallbackSecret))
+	mac.Write([]byte("callback"))
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// stableDescription is the text/plain entry used in stateless mode if no
+// description is configured. Unlike the random default, it is the same for
+// every pay request.
+func (s *Server) stableDescription(user *User) string {
+	if user == nil {
+		return fmt.Sprintf("Payment to %s", s.cfg.Host)
+	}
+
+	return fmt.Sprintf("Payment to %s", s.lnAddressFor(user.Username))
+}
+
+// metadataHash returns the prefix of the metadata hash that callback tokens
+// commit to.
+func metadataHash(data string) []byte {
+	h := sha256.Sum256([]byte(data))
+	return h[:callbackMetaHashLen]
+}
@@ -0,0 +1,460 @@
+// Package client implements the LN WALLET side of LNURL-pay so that Lightning
+// Addresses and LNURLs can be paid programmatically.
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ellemouton/lndurl"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+const (
+	// lightningPrefix is the URI scheme that LNURLs may be prefixed with.
+	lightningPrefix = "lightning:"
+
+	// lnAddressPath is the path under which Lightning Addresses are
+	// served.
+	lnAddressPath = "/.well-known/lnurlp/"
+
+	// maxResponseSize is the max size of a response that we read from
+	// LN SERVICE.
+	maxResponseSize = 1 << 20
+)
+
+// The LUD-17 schemes that LNURLs may be given as instead of bech32.
+const (
+	// SchemePay is the scheme of LNURL-pay URLs.
+	SchemePay = "lnurlp"
+
+	// SchemeWithdraw is the scheme of LNURL-withdraw URLs.
+	SchemeWithdraw = "lnurlw"
+
+	// SchemeAuth is the scheme of LNURL-auth URLs.
+	SchemeAuth = "keyauth"
+)
+
+// Config holds the settings of the client.
+type Config struct {
+	// HTTPClient is used to make requests to LN SERVICE. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	// AllowHTTP allows plain http URLs. Lightning Addresses and lnurlp://
+	// URLs are then resolved to http too. It is meant for local testing.
+	AllowHTTP bool
+}
+
+// Client talks to LN SERVICEs on behalf of a wallet.
+type Client struct {
+	httpClient *http.Client
+	allowHTTP  bool
+}
+
+// New creates a client with the given config. A nil config uses the defaults.
+func New(cfg *Config) *Client {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		httpClient: httpClient,
+		allowHTTP:  cfg.AllowHTTP,
+	}
+}
+
+// Resolve turns a bech32 encoded LNURL (optionally prefixed with lightning:),
+// an lnurlp:// URL or a Lightning Address into the URL of the pay parameters.
+func (c *Client) Resolve(target string) (string, error) {
+	target = trimLightningPrefix(target)
+
+	lower := strings.ToLower(target)
+	if strings.HasPrefix(lower, "lnurl1") ||
+		strings.HasPrefix(lower, SchemePay+"://") ||
+		!strings.Contains(target, "@") {
+
+		return c.ResolveURL(target, SchemePay)
+	}
+
+	parts := strings.Split(target, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid Lightning Address '%s', "+
+			"expected the form <username>@<domain>", target)
+	}
+
+	username, domain := parts[0], parts[1]
+	payURL := fmt.Sprintf(
+		"%s://%s%s%s", c.protocol(), domain, lnAddressPath,
+		url.PathEscape(strings.ToLower(username)),
+	)
+
+	if err := c.checkURL(payURL); err != nil {
+		return "", err
+	}
+
+	return payURL, nil
+}
+
+// ResolveURL turns a bech32 encoded LNURL (optionally prefixed with
+// lightning:) or a URL with the given LUD-17 scheme, such as SchemeWithdraw,
+// into the URL that it encodes.
+func (c *Client) ResolveURL(target, scheme string) (string, error) {
+	target = trimLightningPrefix(target)
+
+	var rawURL string
+	switch lower := strings.ToLower(target); {
+	case strings.HasPrefix(lower, "lnurl1"):
+		var err error
+		rawURL, err = lndurl.DecodeURL(target)
+		if err != nil {
+			return "", fmt.Errorf("could not decode LNURL: %w", err)
+		}
+
+	case strings.HasPrefix(lower, scheme+"://"):
+		rawURL = c.protocol() + target[len(scheme):]
+
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedScheme, target)
+	}
+
+	if err := c.checkURL(rawURL); err != nil {
+		return "", err
+	}
+
+	return rawURL, nil
+}
+
+// trimLightningPrefix removes surrounding whitespace and the lightning: URI
+// scheme, if any, from the given LNURL.
+func trimLightningPrefix(target string) string {
+	target = strings.TrimSpace(target)
+	if strings.HasPrefix(strings.ToLower(target), lightningPrefix) {
+		target = target[len(lightningPrefix):]
+	}
+
+	return target
+}
+
+// protocol returns the protocol that LUD-17 URLs and Lightning Addresses are
+// resolved to.
+func (c *Client) protocol() string {
+	if c.allowHTTP {
+		return "http"
+	}
+
+	return "https"
+}
+
+// checkURL checks that the URL is valid and uses https, unless http is
+// allowed.
+func (c *Client) checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && c.allowHTTP:
+	case u.Scheme == "http":
+		return fmt.Errorf("%w: %s", ErrInsecureURL, rawURL)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedScheme, rawURL)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("invalid url: %s has no host", rawURL)
+	}
+
+	return nil
+}
+
+// FetchPayParams fetches the pay parameters from the given URL, as returned
+// by Resolve, and checks that they are consistent and that the metadata is
+// valid.
+func (c *Client) FetchPayParams(ctx context.Context,
+	payURL string) (*lndurl.PayResponse, error) {
+
+	if err := c.checkURL(payURL); err != nil {
+		return nil, err
+	}
+
+	var params lndurl.PayResponse
+	if err := c.get(ctx, payURL, &params); err != nil {
+		return nil, err
+	}
+
+	if params.Tag != lndurl.TypePayRequest {
+		return nil, fmt.Errorf("%w: expected %s, got '%s'",
+			ErrUnexpectedTag, lndurl.TypePayRequest, params.Tag)
+	}
+
+	switch {
+	case params.Callback == "":
+		return nil, fmt.Errorf("%w: no callback", ErrInvalidPayParams)
+
+	case params.MinSendable <= 0 ||
+		params.MinSendable > params.MaxSendable:
+
+		return nil, fmt.Errorf("%w: invalid sendable range %d-%d msat",
+			ErrInvalidPayParams, params.MinSendable,
+			params.MaxSendable)
+	}
+
+	if _, err := lndurl.ParseMetadata(params.Metadata); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayParams, err)
+	}
+
+	if err := c.checkURL(params.Callback); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayParams, err)
+	}
+
+	return &params, nil
+}
+
+// InvoiceRequest holds the parameters that are sent to the callback.
+type InvoiceRequest struct {
+	// AmountMsat is the amount to pay.
+	AmountMsat int64
+
+	// Comment is an optional comment sent along with the payment.
+	Comment string
+
+	// PayerData is optional data about the payer. It is only sent if LN
+	// SERVICE asked for payer data.
+	PayerData *lndurl.PayerData
+}
+
+// Invoice is an invoice returned by the callback along with what it was
+// requested for.
+type Invoice struct {
+	*lndurl.InvoiceResponse
+
+	// Params are the pay parameters that the invoice was requested with.
+	Params *lndurl.PayResponse
+
+	// AmountMsat is the amount that was requested.
+	AmountMsat int64
+
+	// Description is the raw metadata followed by the raw payer data,
+	// which the invoice's description hash must commit to.
+	Description string
+}
+
+// RequestInvoice checks the request against the pay parameters and requests
+// an invoice from the callback.
+func (c *Client) RequestInvoice(ctx context.Context,
+	params *lndurl.PayResponse, req *InvoiceRequest) (*Invoice, error) {
+
+	if req.AmountMsat < params.MinSendable ||
+		req.AmountMsat > params.MaxSendable {
+
+		return nil, fmt.Errorf("%w: expected an amount between %d and "+
+			"%d msat, got %d", ErrAmountOutOfRange,
+			params.MinSendable, params.MaxSendable, req.AmountMsat)
+	}
+
+	if req.Comment != "" && params.CommentAllowed == 0 {
+		return nil, fmt.Errorf("%w: LN SERVICE does not accept "+
+			"comments", ErrCommentNotAllowed)
+	}
+	if utf8.RuneCountInString(req.Comment) > params.CommentAllowed {
+		return nil, fmt.Errorf("%w: comment exceeds the %d characters "+
+			"allowed by LN SERVICE", ErrCommentNotAllowed,
+			params.CommentAllowed)
+	}
+
+	if params.PayerData != nil {
+		payerData := req.PayerData
+		if payerData == nil {
+			payerData = &lndurl.PayerData{}
+		}
+
+		var authK1 string
+		if params.PayerData.Auth != nil {
+			authK1 = params.PayerData.Auth.K1
+		}
+
+		err := payerData.Validate(params.PayerData, authK1)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPayerData,
+				err)
+		}
+	}
+
+	callback, err := url.Parse(params.Callback)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayParams, err)
+	}
+
+	query := callback.Query()
+	query.Set("amount", strconv.FormatInt(req.AmountMsat, 10))
+	if req.Comment != "" {
+		query.Set("comment", req.Comment)
+	}
+
+	description := params.Metadata
+	if req.PayerData != nil && params.PayerData != nil {
+		payerData, err := json.Marshal(req.PayerData)
+		if err != nil {
+			return nil, err
+		}
+
+		query.Set("payerdata", string(payerData))
+		description += string(payerData)
+	}
+	callback.RawQuery = query.Encode()
+
+	var resp lndurl.InvoiceResponse
+	if err := c.get(ctx, callback.String(), &resp); err != nil {
+		return nil, err
+	}
+
+	return &Invoice{
+		InvoiceResponse: &resp,
+		Params:          params,
+		AmountMsat:      req.AmountMsat,
+		Description:     description,
+	}, nil
+}
+
+// VerifyInvoice decodes the invoice for the given network and checks that it
+// is for the requested amount, that it hasn't expired, that it commits to the
+// metadata that it was requested for and that its success action is valid.
+func (c *Client) VerifyInvoice(inv *Invoice,
+	chainParams *chaincfg.Params) (*zpay32.Invoice, error) {
+
+	// zpay32 accepts invoices of networks whose prefix starts with ours,
+	// so we check the network first.
+	err := lndurl.CheckInvoiceNetwork(inv.PayRequest, chainParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice: %w", err)
+	}
+
+	decoded, err := zpay32.Decode(inv.PayRequest, chainParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice: %w", err)
+	}
+
+	if decoded.MilliSat == nil {
+		return nil, fmt.Errorf("%w: expected %d msat, got an "+
+			"invoice without amount", ErrAmountMismatch,
+			inv.AmountMsat)
+	}
+	if int64(*decoded.MilliSat) != inv.AmountMsat {
+		return nil, fmt.Errorf("%w: expected %d msat, got %d msat",
+			ErrAmountMismatch, inv.AmountMsat, *decoded.MilliSat)
+	}
+
+	expiry := decoded.Timestamp.Add(decoded.Expiry())
+	if !time.Now().Before(expiry) {
+		return nil, fmt.Errorf("%w: expired at %v", ErrInvoiceExpired,
+			expiry)
+	}
+
+	hash := sha256.Sum256([]byte(inv.Description))
+	if decoded.DescriptionHash == nil || *decoded.DescriptionHash != hash {
+		return nil, ErrDescriptionHashMismatch
+	}
+
+	if inv.SuccessAction != nil {
+		err := validateSuccessAction(
+			inv.SuccessAction, inv.Params.Callback,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return decoded, nil
+}
+
+// validateSuccessAction checks that the success action is well-formed and,
+// for url actions, that the url has the same domain as the callback.
+func validateSuccessAction(action *lndurl.SuccessAction,
+	callback string) error {
+
+	if err := action.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSuccessAction, err)
+	}
+
+	if action.Tag != lndurl.SuccessActionURL {
+		return nil
+	}
+
+	actionURL, err := url.Parse(action.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSuccessAction, err)
+	}
+
+	callbackURL, err := url.Parse(callback)
+	if err != nil {
+		return err
+	}
+
+	if actionURL.Hostname() != callbackURL.Hostname() {
+		return fmt.Errorf("%w: url domain %s does not match callback "+
+			"domain %s", ErrInvalidSuccessAction,
+			actionURL.Hostname(), callbackURL.Hostname())
+	}
+
+	return nil
+}
+
+// get makes a GET request to the given URL and decodes the JSON response into
+// out. LNURL error responses are returned as a ServiceError.
+func (c *Client) get(ctx context.Context, rawURL string,
+	out interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("GET request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("could not read response body: %w", err)
+	}
+
+	// LN SERVICE may respond with an error instead of the expected
+	// response, so check for that first.
+	var lnurlErr lndurl.Error
+	if err := json.Unmarshal(body, &lnurlErr); err == nil &&
+		lnurlErr.Status == lndurl.StatusError {
+
+		return &ServiceError{Reason: lnurlErr.Reason}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPError{StatusCode: resp.StatusCode}
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+
+	return nil
+}
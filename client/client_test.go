@@ -0,0 +1,392 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ellemouton/lndurl"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer runs an lndurl server for the user alice backed by a fake
+// node and returns its address.
+func newTestServer(t *testing.T) string {
+	ts := httptest.NewUnstartedServer(nil)
+	addr := ts.Listener.Addr().(*net.TCPAddr)
+
+	cfg := &lndurl.Config{
+		Protocol:        "http",
+		Username:        "alice",
+		Host:            addr.IP.String(),
+		Port:            addr.Port,
+		Network:         lndclient.NetworkRegtest,
+		MinMsatSendable: 1000,
+		MaxMsatSendable: 100000,
+		CommentAllowed:  10,
+	}
+
+	backend, err := lndurl.NewFakeBackend(&chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+
+	s, err := lndurl.NewServer(cfg, backend)
+	require.NoError(t, err)
+
+	ts.Config.Handler = s.Handler()
+	ts.Start()
+	t.Cleanup(func() {
+		ts.Close()
+		require.NoError(t, s.Stop())
+	})
+
+	return addr.String()
+}
+
+// TestResolve tests that the supported targets are resolved to the URL of
+// their pay parameters.
+func TestResolve(t *testing.T) {
+	lnurl, err := lndurl.EncodeURL("https://example.com/pay")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		allowHTTP bool
+		target    string
+		expected  string
+		err       error
+	}{
+		{
+			name:     "bech32 LNURL",
+			target:   lnurl,
+			expected: "https://example.com/pay",
+		},
+		{
+			name:     "lowercase LNURL with lightning prefix",
+			target:   "lightning:" + lnurl,
+			expected: "https://example.com/pay",
+		},
+		{
+			name:     "lnurlp",
+			target:   "lnurlp://example.com/pay",
+			expected: "https://example.com/pay",
+		},
+		{
+			name:      "lnurlp over http",
+			allowHTTP: true,
+			target:    "lnurlp://example.com/pay",
+			expected:  "http://example.com/pay",
+		},
+		{
+			name:   "Lightning Address",
+			target: "Alice@example.com",
+			expected: "https://example.com/.well-known/" +
+				"lnurlp/alice",
+		},
+		{
+			name:   "invalid Lightning Address",
+			target: "alice@",
+			err:    errors.New("invalid Lightning Address"),
+		},
+		{
+			name:   "unsupported scheme",
+			target: "https://example.com/pay",
+			err:    ErrUnsupportedScheme,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			c := New(&Config{AllowHTTP: test.allowHTTP})
+
+			payURL, err := c.Resolve(test.target)
+			if test.err != nil {
+				require.Error(t, err)
+				require.Contains(
+					t, err.Error(), test.err.Error(),
+				)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.expected, payURL)
+		})
+	}
+
+	// Bech32 LNURLs must decode to an https URL.
+	lnurl, err = lndurl.EncodeURL("http://example.com/pay")
+	require.NoError(t, err)
+
+	_, err = New(nil).Resolve(lnurl)
+	require.ErrorIs(t, err, ErrInsecureURL)
+}
+
+// TestResolveURL tests that LNURLs of other types are resolved from bech32 and
+// from their LUD-17 scheme only.
+func TestResolveURL(t *testing.T) {
+	lnurl, err := lndurl.EncodeURL("https://example.com/withdraw?k1=00")
+	require.NoError(t, err)
+
+	c := New(nil)
+
+	rawURL, err := c.ResolveURL("LIGHTNING:"+lnurl, SchemeWithdraw)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/withdraw?k1=00", rawURL)
+
+	rawURL, err = c.ResolveURL(
+		"lnurlw://example.com/withdraw?k1=00", SchemeWithdraw,
+	)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/withdraw?k1=00", rawURL)
+
+	rawURL, err = New(&Config{AllowHTTP: true}).ResolveURL(
+		"keyauth://example.com/auth?tag=login", SchemeAuth,
+	)
+	require.NoError(t, err)
+	require.Equal(t, "http://example.com/auth?tag=login", rawURL)
+
+	_, err = c.ResolveURL("lnurlp://example.com/pay", SchemeWithdraw)
+	require.ErrorIs(t, err, ErrUnsupportedScheme)
+}
+
+// TestPayFlow tests resolving a Lightning Address and requesting and
+// verifying an invoice from an lndurl server.
+func TestPayFlow(t *testing.T) {
+	addr := newTestServer(t)
+	ctx := context.Background()
+	c := New(&Config{AllowHTTP: true})
+
+	payURL, err := c.Resolve("alice@" + addr)
+	require.NoError(t, err)
+
+	params, err := c.FetchPayParams(ctx, payURL)
+	require.NoError(t, err)
+	require.EqualValues(t, 1000, params.MinSendable)
+	require.EqualValues(t, 100000, params.MaxSendable)
+
+	inv, err := c.RequestInvoice(ctx, params, &InvoiceRequest{
+		AmountMsat: 5000,
+		Comment:    "thanks",
+	})
+	require.NoError(t, err)
+	require.Equal(t, params.Metadata, inv.Description)
+
+	decoded, err := c.VerifyInvoice(inv, &chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+	require.EqualValues(t, 5000, *decoded.MilliSat)
+
+	// An invoice that doesn't commit to the metadata is refused.
+	inv.Description += " "
+	_, err = c.VerifyInvoice(inv, &chaincfg.RegressionNetParams)
+	require.ErrorIs(t, err, ErrDescriptionHashMismatch)
+
+	// Requests that LN SERVICE would refuse are caught before they are
+	// sent.
+	_, err = c.RequestInvoice(ctx, params, &InvoiceRequest{
+		AmountMsat: 100001,
+	})
+	require.ErrorIs(t, err, ErrAmountOutOfRange)
+
+	_, err = c.RequestInvoice(ctx, params, &InvoiceRequest{
+		AmountMsat: 5000,
+		Comment:    "far too long",
+	})
+	require.ErrorIs(t, err, ErrCommentNotAllowed)
+
+	emailParams := *params
+	emailParams.PayerData = &lndurl.PayerDataSpec{
+		Email: &lndurl.PayerDataField{Mandatory: true},
+	}
+	_, err = c.RequestInvoice(ctx, &emailParams, &InvoiceRequest{
+		AmountMsat: 5000,
+	})
+	require.ErrorIs(t, err, ErrInvalidPayerData)
+
+	_, err = c.RequestInvoice(ctx, &emailParams, &InvoiceRequest{
+		AmountMsat: 5000,
+		PayerData:  &lndurl.PayerData{Name: "alice"},
+	})
+	require.ErrorIs(t, err, ErrInvalidPayerData)
+
+	// Errors returned by LN SERVICE are passed on.
+	_, err = c.FetchPayParams(ctx, "http://"+addr+"/invoice?id=00")
+	var serviceErr *ServiceError
+	require.ErrorAs(t, err, &serviceErr)
+}
+
+// TestFetchPayParamsErrors tests that unexpected responses are reported with
+// structured errors.
+func TestFetchPayParamsErrors(t *testing.T) {
+	var (
+		status = http.StatusOK
+		body   string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		},
+	))
+	defer ts.Close()
+
+	c := New(&Config{HTTPClient: ts.Client(), AllowHTTP: true})
+	ctx := context.Background()
+
+	body = `{"tag":"withdrawRequest"}`
+	_, err := c.FetchPayParams(ctx, ts.URL)
+	require.ErrorIs(t, err, ErrUnexpectedTag)
+
+	body = `{"tag":"payRequest","callback":"http://x/cb","minSendable":` +
+		`2000,"maxSendable":1000,"metadata":"[]"}`
+	_, err = c.FetchPayParams(ctx, ts.URL)
+	require.ErrorIs(t, err, ErrInvalidPayParams)
+
+	// The metadata must contain a text/plain entry.
+	body = `{"tag":"payRequest","callback":"http://x/cb","minSendable":` +
+		`1000,"maxSendable":2000,"metadata":"[[\"text/email\",` +
+		`\"a@b.c\"]]"}`
+	_, err = c.FetchPayParams(ctx, ts.URL)
+	require.ErrorIs(t, err, ErrInvalidPayParams)
+	require.Contains(t, err.Error(), "text/plain")
+
+	status, body = http.StatusInternalServerError, "oops"
+	_, err = c.FetchPayParams(ctx, ts.URL)
+	var httpErr *HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	require.Equal(t, http.StatusInternalServerError, httpErr.StatusCode)
+
+	// Plain http is refused unless it is allowed.
+	_, err = New(nil).FetchPayParams(ctx, ts.URL)
+	require.ErrorIs(t, err, ErrInsecureURL)
+}
+
+// signInvoice creates a payment request for the given network that was
+// created at the given time and commits to the given description.
+func signInvoice(t *testing.T, chainParams *chaincfg.Params,
+	timestamp time.Time, amtMsat int64, description string) string {
+
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+
+	inv, err := zpay32.NewInvoice(
+		chainParams, [32]byte{1}, timestamp,
+		zpay32.Amount(lnwire.MilliSatoshi(amtMsat)),
+		zpay32.DescriptionHash(sha256.Sum256([]byte(description))),
+		zpay32.Expiry(time.Hour),
+	)
+	require.NoError(t, err)
+
+	pr, err := inv.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return btcec.SignCompact(
+				btcec.S256(), key, chainhash.HashB(msg), true,
+			)
+		},
+	})
+	require.NoError(t, err)
+
+	return pr
+}
+
+// TestVerifyInvoice tests that invoices for another network or amount,
+// expired invoices and invoices that don't commit to the metadata are
+// refused.
+func TestVerifyInvoice(t *testing.T) {
+	const metadata = `[["text/plain","hi"]]`
+
+	var (
+		regtest = &chaincfg.RegressionNetParams
+		mainnet = &chaincfg.MainNetParams
+		now     = time.Now()
+	)
+
+	sign := func(chainParams *chaincfg.Params, timestamp time.Time,
+		amtMsat int64, description string) string {
+
+		return signInvoice(
+			t, chainParams, timestamp, amtMsat, description,
+		)
+	}
+
+	tests := []struct {
+		name        string
+		pr          string
+		chainParams *chaincfg.Params
+		err         error
+	}{
+		{
+			name:        "valid",
+			pr:          sign(regtest, now, 5000, metadata),
+			chainParams: regtest,
+		},
+		{
+			name:        "valid mainnet",
+			pr:          sign(mainnet, now, 5000, metadata),
+			chainParams: mainnet,
+		},
+		{
+			name:        "regtest invoice on mainnet",
+			pr:          sign(regtest, now, 5000, metadata),
+			chainParams: mainnet,
+			err:         ErrNetworkMismatch,
+		},
+		{
+			name:        "mainnet invoice on regtest",
+			pr:          sign(mainnet, now, 5000, metadata),
+			chainParams: regtest,
+			err:         ErrNetworkMismatch,
+		},
+		{
+			name:        "wrong amount",
+			pr:          sign(regtest, now, 2000, metadata),
+			chainParams: regtest,
+			err:         ErrAmountMismatch,
+		},
+		{
+			name: "expired",
+			pr: sign(
+				regtest, now.Add(-2*time.Hour), 5000, metadata,
+			),
+			chainParams: regtest,
+			err:         ErrInvoiceExpired,
+		},
+		{
+			name:        "wrong description hash",
+			pr:          sign(regtest, now, 5000, "hi"),
+			chainParams: regtest,
+			err:         ErrDescriptionHashMismatch,
+		},
+	}
+
+	c := New(nil)
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			inv := &Invoice{
+				InvoiceResponse: &lndurl.InvoiceResponse{
+					PayRequest: test.pr,
+				},
+				Params: &lndurl.PayResponse{
+					Metadata: metadata,
+				},
+				AmountMsat:  5000,
+				Description: metadata,
+			}
+
+			_, err := c.VerifyInvoice(inv, test.chainParams)
+			require.ErrorIs(t, err, test.err)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ellemouton/lndurl"
+)
+
+var (
+	// ErrUnsupportedScheme is returned if a target is neither an LNURL,
+	// an lnurlp:// URL nor a Lightning Address.
+	ErrUnsupportedScheme = errors.New("unsupported scheme")
+
+	// ErrInsecureURL is returned for plain http URLs unless the client
+	// is configured to allow them.
+	ErrInsecureURL = errors.New("url is not https")
+
+	// ErrUnexpectedTag is returned if LN SERVICE responds with anything
+	// but pay parameters.
+	ErrUnexpectedTag = errors.New("unexpected LNURL tag")
+
+	// ErrInvalidPayParams is returned if the pay parameters returned by
+	// LN SERVICE are inconsistent.
+	ErrInvalidPayParams = errors.New("invalid pay parameters")
+
+	// ErrAmountOutOfRange is returned if the requested amount is not
+	// accepted by LN SERVICE.
+	ErrAmountOutOfRange = errors.New("amount out of range")
+
+	// ErrCommentNotAllowed is returned if a comment is sent to an LN
+	// SERVICE that doesn't accept comments, or one that is too long.
+	ErrCommentNotAllowed = errors.New("comment not allowed")
+
+	// ErrInvalidPayerData is returned if the payer data doesn't provide
+	// the mandatory fields requested by LN SERVICE, or provides fields
+	// that it didn't request.
+	ErrInvalidPayerData = errors.New("invalid payer data")
+
+	// ErrDescriptionHashMismatch is returned if an invoice doesn't commit
+	// to the metadata that it was requested for.
+	ErrDescriptionHashMismatch = errors.New("invoice description hash " +
+		"does not match metadata")
+
+	// ErrNetworkMismatch is returned if an invoice is for another network
+	// than the one that we pay on.
+	ErrNetworkMismatch = lndurl.ErrNetworkMismatch
+
+	// ErrAmountMismatch is returned if the amount of an invoice differs
+	// from the amount that it was requested for.
+	ErrAmountMismatch = errors.New("invoice amount mismatch")
+
+	// ErrInvoiceExpired is returned if an invoice has already expired.
+	ErrInvoiceExpired = errors.New("invoice expired")
+
+	// ErrInvalidSuccessAction is returned if the success action returned
+	// along with an invoice is malformed.
+	ErrInvalidSuccessAction = errors.New("invalid success action")
+)
+
+// ServiceError is an error response returned by LN SERVICE.
+type ServiceError struct {
+	// Reason is the reason given by LN SERVICE.
+	Reason string
+}
+
+// Error returns the reason given by LN SERVICE.
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("LN SERVICE error: %s", e.Reason)
+}
+
+// HTTPError is returned if LN SERVICE responds with an unexpected HTTP status
+// and no LNURL error.
+type HTTPError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+}
+
+// Error returns the HTTP status of the response.
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d", e.StatusCode)
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// ChainParams returns the chain parameters of the given network, as named by
+// lnd's GetInfo or the --network flag of lnd.
+func ChainParams(network string) (*chaincfg.Params, error) {
+	switch network {
+	case "mainnet", "bitcoin":
+		return &chaincfg.MainNetParams, nil
+
+	case "testnet", "testnet3":
+		return &chaincfg.TestNet3Params, nil
+
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+
+	case "simnet":
+		return &chaincfg.SimNetParams, nil
+
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+
+	default:
+		return nil, fmt.Errorf("unknown network '%s'", network)
+	}
+}
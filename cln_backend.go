@@ -0,0 +1,505 @@
+package lndurl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// clnLabelPrefix is the prefix of the labels of the invoices that we
+	// create on Core Lightning.
+	clnLabelPrefix = "lndurl-"
+
+	// clnRetryInterval is how long we wait before calling waitanyinvoice
+	// again after it failed.
+	clnRetryInterval = 10 * time.Second
+
+	// clnWaitTimedOut is the error code of waitanyinvoice if no invoice
+	// was paid within the timeout.
+	clnWaitTimedOut = 904
+)
+
+// ClnBackend is a Backend that talks to Core Lightning over the JSON-RPC
+// interface that lightningd serves on its unix socket.
+type ClnBackend struct {
+	socketPath string
+	nextID     uint64
+
+	// subscribers are notified about the invoices that waitanyinvoice
+	// reports as paid.
+	subscribers map[*clnSubscriber]struct{}
+	mu          sync.Mutex
+
+	ctx    context.Context
+	cancel func()
+	wg     sync.WaitGroup
+}
+
+// clnSubscriber receives the updates of a single invoice subscription.
+type clnSubscriber struct {
+	updates chan InvoiceUpdate
+	ctx     context.Context
+}
+
+// A compile time check to ensure that ClnBackend implements Backend.
+var _ Backend = (*ClnBackend)(nil)
+
+// clnRequest is a JSON-RPC request.
+type clnRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      uint64      `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// clnResponse is a JSON-RPC response.
+type clnResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *ClnError       `json:"error"`
+}
+
+// ClnError is an error returned by lightningd.
+type ClnError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error returns the error message reported by lightningd.
+func (e *ClnError) Error() string {
+	return fmt.Sprintf("cln error %d: %s", e.Code, e.Message)
+}
+
+// clnPayFailed holds the error codes of the pay command that mean that the
+// payment definitely failed: invalid params, already paid to a different
+// destination, permanent failure at the destination, no route found, route
+// too expensive, invoice expired and no attempt left in flight.
+var clnPayFailed = map[int]bool{
+	-32602: true,
+	201:    true,
+	203:    true,
+	205:    true,
+	206:    true,
+	207:    true,
+	210:    true,
+}
+
+// clnMsat is an amount in millisatoshis. Older versions of Core Lightning
+// encode amounts as strings with a "msat" suffix, newer ones as numbers.
+type clnMsat int64
+
+// UnmarshalJSON decodes an amount in either encoding.
+func (m *clnMsat) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	s := strings.TrimSuffix(strings.Trim(string(b), `"`), "msat")
+
+	amt, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid msat amount %s", b)
+	}
+	*m = clnMsat(amt)
+
+	return nil
+}
+
+// clnInvoice is an invoice as returned by listinvoices and waitanyinvoice.
+type clnInvoice struct {
+	PaymentHash        string  `json:"payment_hash"`
+	Status             string  `json:"status"`
+	ExpiresAt          int64   `json:"expires_at"`
+	PayIndex           uint64  `json:"pay_index"`
+	AmountReceivedMsat clnMsat `json:"amount_received_msat"`
+}
+
+// update converts the invoice's status to an InvoiceUpdate.
+func (i *clnInvoice) update() (*InvoiceUpdate, error) {
+	hash, err := lntypes.MakeHashFromStr(i.PaymentHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment hash from cln: %w",
+			err)
+	}
+
+	update := &InvoiceUpdate{
+		Hash:  hash,
+		State: InvoiceStateIssued,
+	}
+
+	switch i.Status {
+	case "paid":
+		update.State = InvoiceStateSettled
+		update.AmountPaidMsat = int64(i.AmountReceivedMsat)
+
+	case "expired":
+		update.State = InvoiceStateExpired
+	}
+
+	return update, nil
+}
+
+// NewClnBackend connects to the lightningd JSON-RPC socket at the given path
+// and starts waiting for paid invoices.
+func NewClnBackend(socketPath string) (*ClnBackend, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b := &ClnBackend{
+		socketPath:  socketPath,
+		subscribers: make(map[*clnSubscriber]struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	// Only invoices that are paid from now on are of interest, earlier
+	// payments are picked up when subscribing.
+	payIndex, err := b.latestPayIndex(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	b.wg.Add(1)
+	go b.waitInvoices(payIndex)
+
+	return b, nil
+}
+
+// call makes a JSON-RPC call over a new connection to lightningd and decodes
+// the result into result. The call is aborted once the context is cancelled.
+func (b *ClnBackend) call(ctx context.Context, method string,
+	params interface{}, result interface{}) error {
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", b.socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock any pending read or write once the context is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	req := &clnRequest{
+		JSONRPC: "2.0",
+		ID:      atomic.AddUint64(&b.nextID, 1),
+		Method:  method,
+		Params:  params,
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("%s failed: %w", method, err)
+	}
+
+	var resp clnResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("%s failed: %w", method, err)
+	}
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	if resp.ID != req.ID {
+		return fmt.Errorf("%s failed: response id %d does not match "+
+			"request id %d", method, resp.ID, req.ID)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Result, result)
+}
+
+// AddInvoice creates an invoice that commits to the hash of the request's
+// description. Core Lightning can't combine a description hash with a memo,
+// so the memo is ignored.
+func (b *ClnBackend) AddInvoice(ctx context.Context, req *InvoiceRequest) (
+	lntypes.Hash, string, error) {
+
+	// lightningd hashes the description itself, so make sure that we
+	// end up with the hash that the caller expects.
+	if sha256.Sum256([]byte(req.Description)) != req.DescriptionHash {
+		return lntypes.Hash{}, "", errors.New("description does not " +
+			"match description hash")
+	}
+
+	hash := req.Preimage.Hash()
+	params := map[string]interface{}{
+		"amount_msat":  req.AmountMsat,
+		"label":        clnLabelPrefix + hash.String(),
+		"description":  req.Description,
+		"expiry":       int64(req.Expiry.Seconds()),
+		"preimage":     req.Preimage.String(),
+		"deschashonly": true,
+	}
+
+	var resp struct {
+		PaymentHash string `json:"payment_hash"`
+		Bolt11      string `json:"bolt11"`
+	}
+	if err := b.call(ctx, "invoice", params, &resp); err != nil {
+		return lntypes.Hash{}, "", err
+	}
+
+	if resp.PaymentHash != hash.String() {
+		return lntypes.Hash{}, "", fmt.Errorf("unexpected payment "+
+			"hash %s", resp.PaymentHash)
+	}
+
+	return hash, resp.Bolt11, nil
+}
+
+// SubscribeInvoices sends an update every time waitanyinvoice reports an
+// invoice as paid. lightningd doesn't notify us about expired invoices.
+func (b *ClnBackend) SubscribeInvoices(ctx context.Context) (
+	<-chan InvoiceUpdate, <-chan error, error) {
+
+	sub := &clnSubscriber{
+		updates: make(chan InvoiceUpdate),
+		ctx:     ctx,
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		delete(b.subscribers, sub)
+		b.mu.Unlock()
+	}()
+
+	return sub.updates, make(chan error), nil
+}
+
+// LookupInvoice fetches the current state of the invoice with the given
+// payment hash.
+func (b *ClnBackend) LookupInvoice(ctx context.Context,
+	hash lntypes.Hash) (*InvoiceUpdate, error) {
+
+	params := map[string]interface{}{
+		"payment_hash": hash.String(),
+	}
+
+	var resp struct {
+		Invoices []*clnInvoice `json:"invoices"`
+	}
+	if err := b.call(ctx, "listinvoices", params, &resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Invoices) != 1 {
+		return nil, fmt.Errorf("unknown invoice %v", hash)
+	}
+
+	return resp.Invoices[0].update()
+}
+
+// latestPayIndex returns the pay index of the invoice that was paid last, or
+// zero if none was paid yet. Without a timeout, waitanyinvoice returns the
+// first invoice paid after the given index right away, so the latest index
+// can be searched for without listing all invoices.
+func (b *ClnBackend) latestPayIndex(ctx context.Context) (uint64, error) {
+	// paidAfter returns the pay index of the first invoice paid after the
+	// given index and false if there is none.
+	paidAfter := func(index uint64) (uint64, bool, error) {
+		params := map[string]interface{}{
+			"lastpay_index": index,
+			"timeout":       0,
+		}
+
+		var inv clnInvoice
+		err := b.call(ctx, "waitanyinvoice", params, &inv)
+
+		var clnErr *ClnError
+		switch {
+		case errors.As(err, &clnErr) && clnErr.Code == clnWaitTimedOut:
+			return 0, false, nil
+
+		case err != nil:
+			return 0, false, err
+		}
+
+		return inv.PayIndex, true, nil
+	}
+
+	// Nothing was paid after bound. We double the index until we get
+	// there and then bisect between the latest index found and bound.
+	var latest uint64
+	bound := uint64(math.MaxUint64)
+	for latest != bound {
+		index := latest * 2
+		if bound != math.MaxUint64 {
+			index = latest + (bound-latest)/2
+		}
+
+		payIndex, ok, err := paidAfter(index)
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			latest = payIndex
+		} else {
+			bound = index
+		}
+	}
+
+	return latest, nil
+}
+
+// waitInvoices calls waitanyinvoice in a loop and notifies the subscribers of
+// every paid invoice. It must be run as a goroutine.
+func (b *ClnBackend) waitInvoices(payIndex uint64) {
+	defer b.wg.Done()
+
+	for {
+		params := map[string]interface{}{
+			"lastpay_index": payIndex,
+		}
+
+		var inv clnInvoice
+		err := b.call(b.ctx, "waitanyinvoice", params, &inv)
+		if b.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Waiting for cln invoices failed, retrying "+
+				"in %v: %v", clnRetryInterval, err)
+
+			select {
+			case <-time.After(clnRetryInterval):
+				continue
+			case <-b.ctx.Done():
+				return
+			}
+		}
+
+		if inv.PayIndex > payIndex {
+			payIndex = inv.PayIndex
+		}
+
+		update, err := inv.update()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		b.mu.Lock()
+		subscribers := make([]*clnSubscriber, 0, len(b.subscribers))
+		for sub := range b.subscribers {
+			subscribers = append(subscribers, sub)
+		}
+		b.mu.Unlock()
+
+		for _, sub := range subscribers {
+			select {
+			case sub.updates <- *update:
+			case <-sub.ctx.Done():
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// PayInvoice pays the given payment request using the pay plugin.
+func (b *ClnBackend) PayInvoice(ctx context.Context, pr string,
+	maxFeeMsat int64) (*PaymentResult, error) {
+
+	params := map[string]interface{}{
+		"bolt11": pr,
+		"maxfee": maxFeeMsat,
+	}
+
+	var resp struct {
+		PaymentPreimage string  `json:"payment_preimage"`
+		Status          string  `json:"status"`
+		AmountMsat      clnMsat `json:"amount_msat"`
+		AmountSentMsat  clnMsat `json:"amount_sent_msat"`
+	}
+	err := b.call(ctx, "pay", params, &resp)
+	var clnErr *ClnError
+	if errors.As(err, &clnErr) && clnPayFailed[clnErr.Code] {
+		return nil, &PaymentFailedError{Err: err}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if resp.Status != "complete" {
+		return nil, fmt.Errorf("payment %s", resp.Status)
+	}
+
+	preimage, err := lntypes.MakePreimageFromStr(resp.PaymentPreimage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PaymentResult{
+		Preimage: preimage,
+		FeeMsat:  int64(resp.AmountSentMsat - resp.AmountMsat),
+	}, nil
+}
+
+// NodeInfo returns information about the Core Lightning node.
+func (b *ClnBackend) NodeInfo(ctx context.Context) (*NodeInfo, error) {
+	var resp struct {
+		ID          string `json:"id"`
+		Alias       string `json:"alias"`
+		Network     string `json:"network"`
+		BlockHeight uint32 `json:"blockheight"`
+	}
+	if err := b.call(ctx, "getinfo", struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+
+	// Core Lightning calls mainnet "bitcoin".
+	network := resp.Network
+	if network == "bitcoin" {
+		network = string(lndclient.NetworkMainnet)
+	}
+
+	return &NodeInfo{
+		Alias:       resp.Alias,
+		PubKey:      resp.ID,
+		Network:     network,
+		BlockHeight: resp.BlockHeight,
+	}, nil
+}
+
+// Close stops waiting for paid invoices.
+func (b *ClnBackend) Close() error {
+	b.cancel()
+	b.wg.Wait()
+
+	return nil
+}
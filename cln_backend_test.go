@@ -0,0 +1,527 @@
+package lndurl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/stretchr/testify/require"
+)
+
+// clnHandler scripts the result of a JSON-RPC method.
+type clnHandler func(params map[string]interface{}) (interface{}, *ClnError)
+
+// fakeCln is a lightningd JSON-RPC server on a unix socket that answers with
+// scripted handlers.
+type fakeCln struct {
+	path     string
+	listener net.Listener
+
+	handlers map[string]clnHandler
+	calls    map[string][]map[string]interface{}
+	mu       sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newFakeCln(t *testing.T) *fakeCln {
+	path := filepath.Join(t.TempDir(), "lightning-rpc")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	f := &fakeCln{
+		path:     path,
+		listener: listener,
+		handlers: make(map[string]clnHandler),
+		calls:    make(map[string][]map[string]interface{}),
+		quit:     make(chan struct{}),
+	}
+
+	f.wg.Add(1)
+	go f.serve()
+
+	t.Cleanup(func() {
+		close(f.quit)
+		listener.Close()
+		f.wg.Wait()
+	})
+
+	return f
+}
+
+// handle sets the handler of the given method.
+func (f *fakeCln) handle(method string, handler clnHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handlers[method] = handler
+}
+
+// lastCall returns the params of the last call to the given method.
+func (f *fakeCln) lastCall(method string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	calls := f.calls[method]
+	if len(calls) == 0 {
+		return nil
+	}
+
+	return calls[len(calls)-1]
+}
+
+func (f *fakeCln) serve() {
+	defer f.wg.Done()
+
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		f.wg.Add(1)
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakeCln) serveConn(conn net.Conn) {
+	defer f.wg.Done()
+	defer conn.Close()
+
+	var req struct {
+		ID     uint64                 `json:"id"`
+		Method string                 `json:"method"`
+		Params map[string]interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	f.calls[req.Method] = append(f.calls[req.Method], req.Params)
+	handler, ok := f.handlers[req.Method]
+	f.mu.Unlock()
+
+	resp := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      req.ID,
+	}
+
+	var (
+		result interface{}
+		clnErr *ClnError
+	)
+	if !ok {
+		clnErr = &ClnError{Code: -32601, Message: "unknown method"}
+	} else {
+		result, clnErr = handler(req.Params)
+	}
+
+	// A nil result without error means that the call blocks until the
+	// test ends.
+	switch {
+	case clnErr != nil:
+		resp["error"] = clnErr
+
+	case result == nil:
+		<-f.quit
+		return
+
+	default:
+		resp["result"] = result
+	}
+
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// newTestClnBackend creates a backend connected to a fake lightningd with no
+// paid invoices.
+func newTestClnBackend(t *testing.T) (*ClnBackend, *fakeCln,
+	chan map[string]interface{}) {
+
+	f := newFakeCln(t)
+
+	paid := make(chan map[string]interface{}, 1)
+	f.handle("waitanyinvoice", func(params map[string]interface{}) (
+		interface{}, *ClnError) {
+
+		// Nothing was paid before the backend was created.
+		if _, ok := params["timeout"]; ok {
+			return nil, &ClnError{
+				Code: clnWaitTimedOut, Message: "Timed out",
+			}
+		}
+
+		select {
+		case inv := <-paid:
+			return inv, nil
+		case <-f.quit:
+			return nil, nil
+		}
+	})
+
+	b, err := NewClnBackend(f.path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, b.Close())
+	})
+
+	return b, f, paid
+}
+
+// TestClnAddInvoice tests that invoices are created with the full
+// description and deschashonly.
+func TestClnAddInvoice(t *testing.T) {
+	b, f, _ := newTestClnBackend(t)
+
+	preimage := lntypes.Preimage{1}
+	hash := preimage.Hash()
+	f.handle("invoice", func(map[string]interface{}) (interface{},
+		*ClnError) {
+
+		return map[string]interface{}{
+			"payment_hash": hash.String(),
+			"bolt11":       "lnbcrt1fake",
+		}, nil
+	})
+
+	description := `[["text/plain","hi"]]`
+	req := &InvoiceRequest{
+		Preimage:        preimage,
+		AmountMsat:      5000,
+		Description:     description,
+		DescriptionHash: sha256.Sum256([]byte(description)),
+		Expiry:          time.Hour,
+	}
+
+	gotHash, pr, err := b.AddInvoice(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, hash, gotHash)
+	require.Equal(t, "lnbcrt1fake", pr)
+
+	params := f.lastCall("invoice")
+	require.EqualValues(t, 5000, params["amount_msat"])
+	require.Equal(t, description, params["description"])
+	require.Equal(t, true, params["deschashonly"])
+	require.Equal(t, preimage.String(), params["preimage"])
+	require.EqualValues(t, 3600, params["expiry"])
+
+	// A description that doesn't match the hash is refused.
+	req.Description = "other"
+	_, _, err = b.AddInvoice(context.Background(), req)
+	require.Error(t, err)
+}
+
+// TestClnSubscribeInvoices tests that invoices are reported as settled once
+// waitanyinvoice returns them and that they can be looked up.
+func TestClnSubscribeInvoices(t *testing.T) {
+	b, f, paid := newTestClnBackend(t)
+
+	preimage := lntypes.Preimage{2}
+	hash := preimage.Hash()
+	f.handle("listinvoices", func(map[string]interface{}) (interface{},
+		*ClnError) {
+
+		return map[string]interface{}{
+			"invoices": []interface{}{map[string]interface{}{
+				"payment_hash": hash.String(),
+				"status":       "unpaid",
+				"expires_at":   time.Now().Add(time.Hour).Unix(),
+			}},
+		}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	update, err := b.LookupInvoice(ctx, hash)
+	require.NoError(t, err)
+	require.Equal(t, hash, update.Hash)
+	require.Equal(t, InvoiceStateIssued, update.State)
+
+	updates, _, err := b.SubscribeInvoices(ctx)
+	require.NoError(t, err)
+
+	// Older versions of Core Lightning encode amounts as strings.
+	paid <- map[string]interface{}{
+		"payment_hash":         hash.String(),
+		"status":               "paid",
+		"pay_index":            1,
+		"amount_received_msat": "5000msat",
+	}
+
+	var settled InvoiceUpdate
+	select {
+	case settled = <-updates:
+	case <-time.After(time.Second):
+		t.Fatal("no invoice update")
+	}
+	require.Equal(t, hash, settled.Hash)
+	require.Equal(t, InvoiceStateSettled, settled.State)
+	require.EqualValues(t, 5000, settled.AmountPaidMsat)
+}
+
+// TestClnLatestPayIndex tests that waiting for invoices starts after the
+// invoice that was paid last.
+func TestClnLatestPayIndex(t *testing.T) {
+	// Invoices with a pay index that is a multiple of 7 were deleted.
+	const latestPayIndex = 1000
+
+	f := newFakeCln(t)
+	f.handle("waitanyinvoice", func(params map[string]interface{}) (
+		interface{}, *ClnError) {
+
+		payIndex := uint64(params["lastpay_index"].(float64)) + 1
+		if payIndex%7 == 0 {
+			payIndex++
+		}
+
+		if payIndex <= latestPayIndex {
+			return map[string]interface{}{
+				"payment_hash": lntypes.Hash{}.String(),
+				"status":       "paid",
+				"pay_index":    payIndex,
+			}, nil
+		}
+
+		if _, ok := params["timeout"]; ok {
+			return nil, &ClnError{
+				Code: clnWaitTimedOut, Message: "Timed out",
+			}
+		}
+
+		// Block until the test ends.
+		return nil, nil
+	})
+
+	b, err := NewClnBackend(f.path)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+
+	require.Eventually(t, func() bool {
+		params := f.lastCall("waitanyinvoice")
+		_, ok := params["timeout"]
+
+		return !ok && params["lastpay_index"] == float64(latestPayIndex)
+	}, time.Second, 10*time.Millisecond)
+
+	// The latest pay index is searched for instead of going through all
+	// paid invoices.
+	f.mu.Lock()
+	require.Less(t, len(f.calls["waitanyinvoice"]), 30)
+	f.mu.Unlock()
+}
+
+// TestClnNodeInfo tests that mainnet is reported under lnd's name.
+func TestClnNodeInfo(t *testing.T) {
+	b, f, _ := newTestClnBackend(t)
+
+	f.handle("getinfo", func(map[string]interface{}) (interface{},
+		*ClnError) {
+
+		return map[string]interface{}{
+			"id":          "02aa",
+			"alias":       "cln",
+			"network":     "bitcoin",
+			"blockheight": 100,
+		}, nil
+	})
+
+	info, err := b.NodeInfo(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "cln", info.Alias)
+	require.Equal(t, string(lndclient.NetworkMainnet), info.Network)
+	require.EqualValues(t, 100, info.BlockHeight)
+}
+
+// TestClnPayInvoice tests that payments report the fee paid and that errors
+// returned by lightningd are passed on, marked as definitive failures where
+// the error code says so.
+func TestClnPayInvoice(t *testing.T) {
+	b, f, _ := newTestClnBackend(t)
+
+	preimage := lntypes.Preimage{3}
+	f.handle("pay", func(map[string]interface{}) (interface{}, *ClnError) {
+		return map[string]interface{}{
+			"payment_preimage": preimage.String(),
+			"status":           "complete",
+			"amount_msat":      5000,
+			"amount_sent_msat": 5200,
+		}, nil
+	})
+
+	res, err := b.PayInvoice(context.Background(), "lnbcrt1fake", 1000)
+	require.NoError(t, err)
+	require.Equal(t, preimage, res.Preimage)
+	require.EqualValues(t, 200, res.FeeMsat)
+
+	params := f.lastCall("pay")
+	require.Equal(t, "lnbcrt1fake", params["bolt11"])
+	require.EqualValues(t, 1000, params["maxfee"])
+
+	f.handle("pay", func(map[string]interface{}) (interface{}, *ClnError) {
+		return nil, &ClnError{Code: 210, Message: "no route"}
+	})
+
+	_, err = b.PayInvoice(context.Background(), "lnbcrt1fake", 1000)
+	var clnErr *ClnError
+	require.ErrorAs(t, err, &clnErr)
+	require.Equal(t, 210, clnErr.Code)
+
+	var failed *PaymentFailedError
+	require.ErrorAs(t, err, &failed)
+
+	// Errors that don't tell whether the payment failed leave its
+	// outcome unknown.
+	f.handle("pay", func(map[string]interface{}) (interface{}, *ClnError) {
+		return nil, &ClnError{Code: -1, Message: "unknown"}
+	})
+
+	_, err = b.PayInvoice(context.Background(), "lnbcrt1fake", 1000)
+	require.ErrorAs(t, err, &clnErr)
+	require.False(t, errors.As(err, &failed))
+}
+
+// TestClnPayFlow tests that the server's pay flow works the same on top of
+// Core Lightning.
+func TestClnPayFlow(t *testing.T) {
+	b, f, paid := newTestClnBackend(t)
+
+	// Let a fake backend sign the invoices that lightningd would create.
+	signer, err := NewFakeBackend(&chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+
+	var (
+		invoices = make(map[string]map[string]interface{})
+		mu       sync.Mutex
+	)
+	f.handle("invoice", func(params map[string]interface{}) (interface{},
+		*ClnError) {
+
+		preimage, err := lntypes.MakePreimageFromStr(
+			params["preimage"].(string),
+		)
+		require.NoError(t, err)
+
+		description := params["description"].(string)
+		hash, pr, err := signer.AddInvoice(
+			context.Background(), &InvoiceRequest{
+				Preimage: preimage,
+				AmountMsat: int64(
+					params["amount_msat"].(float64),
+				),
+				DescriptionHash: sha256.Sum256(
+					[]byte(description),
+				),
+				Expiry: time.Hour,
+			},
+		)
+		require.NoError(t, err)
+
+		mu.Lock()
+		invoices[hash.String()] = map[string]interface{}{
+			"payment_hash": hash.String(),
+			"status":       "unpaid",
+			"expires_at":   time.Now().Add(time.Hour).Unix(),
+		}
+		mu.Unlock()
+
+		return map[string]interface{}{
+			"payment_hash": hash.String(),
+			"bolt11":       pr,
+		}, nil
+	})
+	f.handle("listinvoices", func(params map[string]interface{}) (
+		interface{}, *ClnError) {
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Copy the invoice as it is encoded after we return.
+		list := []interface{}{}
+		if inv, ok := invoices[params["payment_hash"].(string)]; ok {
+			invCopy := make(map[string]interface{}, len(inv))
+			for k, v := range inv {
+				invCopy[k] = v
+			}
+			list = append(list, invCopy)
+		}
+
+		return map[string]interface{}{"invoices": list}, nil
+	})
+
+	cfg := &Config{
+		Protocol:        "http",
+		Username:        "alice",
+		Host:            "example.com",
+		Port:            80,
+		Network:         lndclient.NetworkRegtest,
+		MinMsatSendable: 1000,
+		MaxMsatSendable: 100000,
+	}
+	s, err := NewServer(cfg, b)
+	require.NoError(t, err)
+	require.NoError(t, s.tracker.Start())
+
+	ts := &testServer{Server: s, http: httptest.NewServer(s.Handler())}
+	defer func() {
+		ts.http.Close()
+		require.NoError(t, s.Stop())
+	}()
+
+	payResp, invResp := ts.requestInvoice(t, lnAddressPath+"alice", 5000)
+
+	inv, err := zpay32.Decode(
+		invResp.PayRequest, &chaincfg.RegressionNetParams,
+	)
+	require.NoError(t, err)
+	require.Equal(
+		t, sha256.Sum256([]byte(payResp.Metadata)),
+		*inv.DescriptionHash,
+	)
+
+	// The invoice may be looked up before or after waitanyinvoice
+	// returns it.
+	hash := hex.EncodeToString(inv.PaymentHash[:])
+	settled := map[string]interface{}{
+		"payment_hash":         hash,
+		"status":               "paid",
+		"pay_index":            1,
+		"amount_received_msat": 5000,
+	}
+	mu.Lock()
+	invoices[hash] = settled
+	mu.Unlock()
+	paid <- settled
+
+	require.Eventually(t, func() bool {
+		balance, err := s.ledger.Balance("alice")
+		require.NoError(t, err)
+
+		return balance == 5000
+	}, time.Second, 10*time.Millisecond)
+
+	// An unknown invoice id still fails in the same way.
+	var errResp Error
+	code := ts.get(t, "/invoice", url.Values{
+		"id": {"00"}, "amount": {"5000"},
+	}, &errResp)
+	require.Equal(t, http.StatusNotFound, code)
+}
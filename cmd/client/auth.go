@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+
+	"github.com/ellemouton/lndurl"
+	"github.com/ellemouton/lndurl/client"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/tv42/zbase32"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// derivationLUD05 derives linking keys from a BIP32 seed as described
+	// in LUD-05.
+	derivationLUD05 = "lud05"
+
+	// derivationLUD13 derives linking keys from a signature by the node's
+	// identity key as described in LUD-13.
+	derivationLUD13 = "lud13"
+
+	// defaultSignMacaroon is the macaroon in lnd's macaroon dir that is
+	// used to sign the LUD-13 canonical phrase if none is given.
+	defaultSignMacaroon = "message.macaroon"
+
+	// lud13CanonicalPhrase is the message that is signed to derive the
+	// LUD-13 hashing key.
+	lud13CanonicalPhrase = "DO NOT EVER SIGN THIS TEXT WITH YOUR " +
+		"PRIVATE KEYS! IT IS ONLY USED FOR DERIVATION OF LNURL-AUTH " +
+		"HASHING-KEY, DISCLOSING ITS SIGNATURE WILL COMPROMISE YOUR " +
+		"LNURL-AUTH IDENTITY AND MAY LEAD TO LOSS OF FUNDS!"
+)
+
+var authCommand = &cli.Command{
+	Name:  "auth",
+	Usage: "Log in to an LNURL-auth service",
+	Description: `Sign an LNURL-auth challenge with a linking key derived
+	for the service's domain`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "lnurl",
+			Usage: "The LNURL to authenticate with.",
+		},
+		&cli.StringFlag{
+			Name: "derivation",
+			Usage: "How to derive the linking key. Either 'lud13' " +
+				"which derives it from a signature by the " +
+				"node's identity key, or 'lud05' which derives " +
+				"it from the BIP32 seed given by --seed",
+			Value: derivationLUD13,
+		},
+		&cli.StringFlag{
+			Name:  "seed",
+			Usage: "hex encoded BIP32 seed used for lud05 derivation",
+		},
+		&cli.StringFlag{
+			Name: "macaroon",
+			Usage: "path to the macaroon used for lud13 " +
+				"derivation, which only needs the " +
+				"message:write permission (lncli " +
+				"bakemacaroon message:write), defaults to " +
+				defaultSignMacaroon + " in the mac dir",
+		},
+		&cli.BoolFlag{
+			Name:  "notls",
+			Usage: "set to true to use http instead of https",
+		},
+	},
+	Action: authToLNURL,
+}
+
+func authToLNURL(ctx *cli.Context) error {
+	// LNURL must be specified.
+	lnurl := ctx.String("lnurl")
+	if lnurl == "" {
+		return fmt.Errorf("missing '--lnurl' flag")
+	}
+
+	c := client.New(&client.Config{
+		AllowHTTP: ctx.Bool("notls"),
+	})
+
+	authURL, err := c.ResolveURL(lnurl, client.SchemeAuth)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	query := u.Query()
+	if tag := query.Get("tag"); tag != lndurl.TagLogin {
+		return fmt.Errorf("expected a '%s' LNURL, got '%s'",
+			lndurl.TagLogin, tag)
+	}
+
+	k1, err := hex.DecodeString(query.Get("k1"))
+	if err != nil || len(k1) != 32 {
+		return fmt.Errorf("k1 must be 32 hex encoded bytes")
+	}
+
+	// The linking key is specific to the domain of the service so that
+	// the user can't be tracked across services.
+	domain := u.Hostname()
+
+	var linkingKey *btcec.PrivateKey
+	switch ctx.String("derivation") {
+	case derivationLUD05:
+		seed, err := hex.DecodeString(ctx.String("seed"))
+		if err != nil || len(seed) == 0 {
+			return fmt.Errorf("lud05 derivation requires a hex " +
+				"encoded '--seed'")
+		}
+
+		linkingKey, err = deriveLUD05LinkingKey(seed, domain)
+		if err != nil {
+			return err
+		}
+
+	case derivationLUD13:
+		sig, err := signMessage(ctx, []byte(lud13CanonicalPhrase))
+		if err != nil {
+			return fmt.Errorf("could not sign canonical phrase: %w",
+				err)
+		}
+
+		linkingKey = deriveLUD13LinkingKey(sig, domain)
+
+	default:
+		return fmt.Errorf("unknown derivation '%s'",
+			ctx.String("derivation"))
+	}
+
+	sig, err := linkingKey.Sign(k1)
+	if err != nil {
+		return fmt.Errorf("could not sign k1: %w", err)
+	}
+
+	key := linkingKey.PubKey().SerializeCompressed()
+	query.Set("sig", hex.EncodeToString(sig.Serialize()))
+	query.Set("key", hex.EncodeToString(key))
+	u.RawQuery = query.Encode()
+
+	var status lndurl.StatusResponse
+	if err := get(u.String(), &status); err != nil {
+		return err
+	}
+
+	if status.Status != lndurl.StatusOK {
+		return fmt.Errorf("unexpected status from LN SERVICE: %s",
+			status.Status)
+	}
+
+	fmt.Printf("Successfully authenticated to %s with linking key %x\n",
+		domain, key)
+
+	return nil
+}
+
+// signMessage signs the message with the node's identity key using lnd's
+// signmessage RPC, as LUD-13 requires, and returns the zbase32 decoded
+// signature. Unlike the signer's SignMessage, it signs the message with lnd's
+// message prefix and returns a recoverable signature, which is what other
+// wallets derive their LUD-13 keys from.
+func signMessage(ctx *cli.Context, msg []byte) ([]byte, error) {
+	creds, err := credentials.NewClientTLSFromFile(
+		ctx.String("tlspath"), "",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS cert: %w", err)
+	}
+
+	macPath := ctx.String("macaroon")
+	if macPath == "" {
+		macPath = filepath.Join(
+			ctx.String("macpath"), defaultSignMacaroon,
+		)
+	}
+
+	mac, err := ioutil.ReadFile(macPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load macaroon: %w", err)
+	}
+
+	conn, err := grpc.DialContext(
+		ctx.Context, ctx.String("host"),
+		grpc.WithTransportCredentials(creds),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to LND: %w", err)
+	}
+	defer conn.Close()
+
+	rpcCtx := metadata.AppendToOutgoingContext(
+		ctx.Context, "macaroon", hex.EncodeToString(mac),
+	)
+	resp, err := lnrpc.NewLightningClient(conn).SignMessage(
+		rpcCtx, &lnrpc.SignMessageRequest{Msg: msg},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return zbase32.DecodeString(resp.Signature)
+}
+
+// deriveLUD05LinkingKey derives the linking key for the given domain from a
+// BIP32 seed:
+//
+//	hashingKey = m/138'/0
+//	derivationMaterial = hmacSha256(hashingKey, domain)
+//	linkingKey = m/138'/<first 16 bytes of derivationMaterial as 4 uint32s>
+func deriveLUD05LinkingKey(seed []byte, domain string) (*btcec.PrivateKey,
+	error) {
+
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		return nil, err
+	}
+
+	purpose, err := master.Derive(hdkeychain.HardenedKeyStart + 138)
+	if err != nil {
+		return nil, err
+	}
+
+	hashingKey, err := purpose.Derive(0)
+	if err != nil {
+		return nil, err
+	}
+
+	hashingPriv, err := hashingKey.ECPrivKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key := purpose
+	suffix := lud05PathSuffix(hashingPriv.Serialize(), domain)
+	for _, index := range suffix {
+		key, err = key.Derive(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key.ECPrivKey()
+}
+
+// lud05PathSuffix returns the indices of the linking key below m/138' for the
+// given domain: the first 16 bytes of hmacSha256(hashingKey, domain) as four
+// big endian uint32s.
+func lud05PathSuffix(hashingKey []byte, domain string) [4]uint32 {
+	mac := hmac.New(sha256.New, hashingKey)
+	mac.Write([]byte(domain))
+	material := mac.Sum(nil)
+
+	var suffix [4]uint32
+	for i := range suffix {
+		suffix[i] = binary.BigEndian.Uint32(material[i*4 : (i+1)*4])
+	}
+
+	return suffix
+}
+
+// deriveLUD13LinkingKey derives the linking key for the given domain from the
+// signature of the LUD-13 canonical phrase:
+//
+//	hashingKey = sha256(signature)
+//	linkingKey = hmacSha256(hashingKey, domain)
+func deriveLUD13LinkingKey(sig []byte, domain string) *btcec.PrivateKey {
+	hashingKey := sha256.Sum256(sig)
+
+	mac := hmac.New(sha256.New, hashingKey[:])
+	mac.Write([]byte(domain))
+
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), mac.Sum(nil))
+
+	return priv
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/lightningnetwork/lnd/keychain"
+	"github.com/stretchr/testify/require"
+)
+
+// bip32Key is an extended private key of the reference BIP32 derivation.
+type bip32Key struct {
+	key       []byte
+	chainCode []byte
+}
+
+// bip32Master derives the master key of the given seed as specified in BIP32.
+func bip32Master(seed []byte) *bip32Key {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	i := mac.Sum(nil)
+
+	return &bip32Key{key: i[:32], chainCode: i[32:]}
+}
+
+// child derives the private child key at the given index as specified in
+// BIP32. Together with bip32Master it checks the derivation of linking keys
+// independently of hdkeychain.
+func (k *bip32Key) child(index uint32) *bip32Key {
+	var data []byte
+	if index >= hdkeychain.HardenedKeyStart {
+		data = append([]byte{0}, k.key...)
+	} else {
+		_, pub := btcec.PrivKeyFromBytes(btcec.S256(), k.key)
+		data = pub.SerializeCompressed()
+	}
+
+	var indexBytes [4]byte
+	binary.BigEndian.PutUint32(indexBytes[:], index)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	mac.Write(indexBytes[:])
+	i := mac.Sum(nil)
+
+	key := new(big.Int).SetBytes(i[:32])
+	key.Add(key, new(big.Int).SetBytes(k.key))
+	key.Mod(key, btcec.S256().N)
+
+	child := &bip32Key{key: make([]byte, 32), chainCode: i[32:]}
+	key.FillBytes(child.key)
+
+	return child
+}
+
+// TestBIP32Reference tests the reference BIP32 derivation against test
+// vector 1 of BIP32.
+func TestBIP32Reference(t *testing.T) {
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	require.NoError(t, err)
+
+	tests := []struct {
+		key  *bip32Key
+		xprv string
+	}{
+		{
+			// m
+			key: bip32Master(seed),
+			xprv: "xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2" +
+				"nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF" +
+				"5kejMRNNU3TGtRBeJgk33yuGBxrMPHi",
+		},
+		{
+			// m/0'
+			key: bip32Master(seed).child(
+				hdkeychain.HardenedKeyStart,
+			),
+			xprv: "xprv9uHRZZhk6KAJC1avXpDAp4MDc3sQKNxDiPvv" +
+				"kX8Br5ngLNv1TxvUxt4cV1rGL5hj6KCesnDYUhd7" +
+				"oWgT11eZG7XnxHrnYeSvkzY7d2bhkJ7",
+		},
+		{
+			// m/0'/1
+			key: bip32Master(seed).child(
+				hdkeychain.HardenedKeyStart,
+			).child(1),
+			xprv: "xprv9wTYmMFdV23N2TdNG573QoEsfRrWKQgWeibm" +
+				"LntzniatZvR9BmLnvSxqu53Kw1UmYPxLgboyZQaX" +
+				"wTCg8MSY3H2EU4pWcQDnRnrVA1xe8fs",
+		},
+	}
+
+	for _, test := range tests {
+		expected, err := hdkeychain.NewKeyFromString(test.xprv)
+		require.NoError(t, err)
+
+		priv, err := expected.ECPrivKey()
+		require.NoError(t, err)
+		require.Equal(t, priv.Serialize(), test.key.key)
+		require.Equal(t, expected.ChainCode(), test.key.chainCode)
+	}
+}
+
+// TestLUD05LinkingKey tests LUD-05 key derivation against the path test
+// vector of the spec and against the reference BIP32 derivation.
+func TestLUD05LinkingKey(t *testing.T) {
+	hashingKey, err := hex.DecodeString("7d417a6a5e9a6a4a879aeaba11a1183" +
+		"8764c8fa2b959c242d43dea682b3e409b")
+	require.NoError(t, err)
+
+	require.Equal(
+		t, [4]uint32{1588488367, 2659270754, 38110259, 4136336762},
+		lud05PathSuffix(hashingKey, "site.com"),
+	)
+
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	require.NoError(t, err)
+
+	linkingKey, err := deriveLUD05LinkingKey(seed, "site.com")
+	require.NoError(t, err)
+
+	// The linking key is derived below m/138' using the path suffix of
+	// the hashing key m/138'/0.
+	purpose := bip32Master(seed).child(hdkeychain.HardenedKeyStart + 138)
+	expected := purpose
+	for _, index := range lud05PathSuffix(
+		purpose.child(0).key, "site.com",
+	) {
+		expected = expected.child(index)
+	}
+	require.Equal(t, expected.key, linkingKey.Serialize())
+
+	require.Equal(
+		t, "472d46801cf24027f1bc52cdcc606b53f3b519bd9d3df28e844e978e"+
+			"2f4b9d23", hex.EncodeToString(linkingKey.Serialize()),
+	)
+
+	// Other domains get unrelated keys.
+	other, err := deriveLUD05LinkingKey(seed, "other.com")
+	require.NoError(t, err)
+	require.NotEqual(t, linkingKey.Serialize(), other.Serialize())
+}
+
+// TestLUD13LinkingKey tests LUD-13 key derivation from a signature of the
+// canonical phrase made by lnd's signmessage implementation.
+func TestLUD13LinkingKey(t *testing.T) {
+	nodeKeyBytes, err := hex.DecodeString("01010101010101010101010101010" +
+		"10101010101010101010101010101010101")
+	require.NoError(t, err)
+	nodeKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), nodeKeyBytes)
+
+	// signmessage signs the double SHA256 of the message with lnd's
+	// prefix and returns a recoverable compact signature.
+	signer := keychain.NewPrivKeyMessageSigner(
+		nodeKey, keychain.KeyLocator{},
+	)
+	sig, err := signer.SignMessageCompact(append(
+		[]byte("Lightning Signed Message:"), lud13CanonicalPhrase...,
+	), true)
+	require.NoError(t, err)
+	require.Equal(
+		t, "2050e4ec6fcb6e4d4852aa46b2ac771a4cf211d12d1d2c73183d8579"+
+			"7d01e9760305d3decb1f0202ec5f571381a38d6dd39a58da490d"+
+			"02ee775c1174ead1aa3c8c", hex.EncodeToString(sig),
+	)
+
+	linkingKey := deriveLUD13LinkingKey(sig, "site.com")
+	require.Equal(
+		t, "76cb71637e60b99031bdaf3cdf084612a81d4572b603f907dc6f2310"+
+			"218d0e90", hex.EncodeToString(linkingKey.Serialize()),
+	)
+
+	other := deriveLUD13LinkingKey(sig, "other.com")
+	require.NotEqual(t, linkingKey.Serialize(), other.Serialize())
+}
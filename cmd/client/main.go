@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ellemouton/lndurl"
+	"github.com/ellemouton/lndurl/client"
 	"github.com/lightninglabs/lndclient"
 
 	"github.com/urfave/cli/v2"
@@ -26,7 +32,8 @@ func main() {
 		&cli.StringFlag{
 			Name:  "network",
 			Value: "regtest",
-			Usage: "the network",
+			Usage: "the network of the lnd node, invoices for " +
+				"other networks are refused",
 		},
 		&cli.StringFlag{
 			Name:  "macpath",
@@ -39,7 +46,9 @@ func main() {
 			Usage: "Path to lnd's tls cert",
 		},
 	}
-	app.Commands = append(app.Commands, payRequestCommand)
+	app.Commands = append(
+		app.Commands, payRequestCommand, withdrawCommand, authCommand,
+	)
 
 	err := app.Run(os.Args)
 	if err != nil {
@@ -64,9 +73,48 @@ func get(url string, out interface{}) error {
 	}
 	defer resp.Body.Close()
 
+	// LN SERVICE may respond with an error instead of the expected
+	// response, so check for that first.
+	var lnurlErr lndurl.Error
+	if err := json.Unmarshal(body, &lnurlErr); err == nil &&
+		lnurlErr.Status == lndurl.StatusError {
+
+		return fmt.Errorf("LN SERVICE error: %s", lnurlErr.Reason)
+	}
+
 	return json.Unmarshal(body, &out)
 }
 
+// promptAmount returns amt if it is within the given bounds. Otherwise, it
+// asks the user to enter an amount until a valid one is given.
+func promptAmount(amt, min, max int64) (int64, error) {
+	for amt < min || amt > max {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Printf("Enter an amount (in millisatoshis) between "+
+			"%d and %d\n", min, max)
+
+		userInput, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, fmt.Errorf("could not read from console: %w",
+				err)
+		}
+		userInput = strings.TrimSpace(userInput)
+
+		amt, err = strconv.ParseInt(userInput, 10, 64)
+		if err != nil {
+			fmt.Printf("error parsing input: %v", err)
+			continue
+		}
+
+		if amt < min || amt > max {
+			fmt.Printf("Invalid amount. Expected an amount "+
+				"between %d and %d, got %d\n", min, max, amt)
+		}
+	}
+
+	return amt, nil
+}
+
 func getLND(ctx *cli.Context) (*lndclient.GrpcLndServices, error) {
 	return lndclient.NewLndServices(&lndclient.LndServicesConfig{
 		LndAddress:  ctx.String("host"),
@@ -75,3 +123,21 @@ func getLND(ctx *cli.Context) (*lndclient.GrpcLndServices, error) {
 		TLSPath:     ctx.String("tlspath"),
 	})
 }
+
+// chainParams returns the chain params of the network that the node runs on,
+// as reported by GetInfo. The node must be on the network set by --network.
+func chainParams(ctx *cli.Context,
+	lnd *lndclient.GrpcLndServices) (*chaincfg.Params, error) {
+
+	info, err := lnd.Client.GetInfo(ctx.Context)
+	if err != nil {
+		return nil, fmt.Errorf("could not get node info: %w", err)
+	}
+
+	if network := ctx.String("network"); info.Network != network {
+		return nil, fmt.Errorf("node is on %s, but --network is %s",
+			info.Network, network)
+	}
+
+	return client.ChainParams(info.Network)
+}
@@ -1,19 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/sha256"
 	"fmt"
-	"os"
-	"strconv"
-	"strings"
 
 	"github.com/ellemouton/lndurl"
+	"github.com/ellemouton/lndurl/client"
 
-	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
-	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/lightningnetwork/lnd/lntypes"
 	"github.com/urfave/cli/v2"
 )
 
@@ -35,6 +29,10 @@ var payRequestCommand = &cli.Command{
 			Usage: "max fee to pay for this payment (in millisats)",
 			Value: 1000,
 		},
+		&cli.StringFlag{
+			Name:  "comment",
+			Usage: "an optional comment to send along with the payment",
+		},
 		&cli.BoolFlag{
 			Name:  "notls",
 			Usage: "set to true to use http instead of https",
@@ -50,138 +48,67 @@ func payToLNURL(ctx *cli.Context) error {
 		return fmt.Errorf("missing '--lnurl' flag")
 	}
 
-	protocol := "https"
-	if ctx.Bool("notls") {
-		protocol = "http"
-	}
-
-	var (
-		url string
-		err error
-	)
-	switch {
-	case strings.HasPrefix(lnurl, "LNURL"):
-		url, err = lndurl.DecodeURL(lnurl)
-		if err != nil {
-			return fmt.Errorf("error decoding LNURL: %w", err)
-		}
-
-	case strings.HasPrefix(lnurl, "lightning:"):
-		fmt.Println(lnurl)
-		url, err = lndurl.DecodeURL(
-			strings.TrimPrefix(lnurl, "lightning:"),
-		)
-		if err != nil {
-			return fmt.Errorf("error decoding LNURL: %w", err)
-		}
-
-	case strings.HasPrefix(lnurl, "lnurlp://"):
-		url = strings.Replace(lnurl, "lnurlp", protocol, 1)
-
-	case strings.Contains(lnurl, "@"):
-		// This is an LN Address:
-		parts := strings.Split(lnurl, "@")
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid LN address. Expected" +
-				"the form <username>@<domain>")
-		}
-
-		username, domain := parts[0], parts[1]
-		url = fmt.Sprintf("%s://%s/.well-known/lnurlp/%s",
-			protocol, domain, username)
+	c := client.New(&client.Config{
+		AllowHTTP: ctx.Bool("notls"),
+	})
 
-	default:
-		return fmt.Errorf("unsupported scheme")
+	payURL, err := c.Resolve(lnurl)
+	if err != nil {
+		return err
 	}
 
-	// Ensure that the url uses the tls if we have not set --notls
-	if !ctx.Bool("notls") && !strings.HasPrefix(url, "https") {
-		return fmt.Errorf("url is not https")
+	payResp, err := c.FetchPayParams(ctx.Context, payURL)
+	if err != nil {
+		return err
 	}
 
-	// Make a GET request to the decoded LNURL.
-	var payResp lndurl.PayResponse
-	if err := get(url, &payResp); err != nil {
+	// The metadata has already been validated by the client.
+	meta, err := lndurl.ParseMetadata(payResp.Metadata)
+	if err != nil {
 		return err
 	}
 
-	// Ensure that the response contains the necessary metadata field.
-	var meta string
-	for _, d := range payResp.Metadata {
-		if d[0] == "text/plain" {
-			meta = d[1]
-		}
+	fmt.Printf("Paying: %s\n", meta.Description())
+	if longDesc, ok := meta.Get(lndurl.MetadataLongDesc); ok {
+		fmt.Println(longDesc)
 	}
-	if meta == "" {
-		return fmt.Errorf("response metadata does not contain the " +
-			"required 'text/plain' field")
-	}
-
-	minSendable := payResp.MinSendable
-	maxSendable := payResp.MaxSendable
 
 	// Check if the user specified an amount in the original call. If they
 	// did not or if the specified amount is not within the bounds specified
 	// in the server response, ask the user to enter a valid amount.
-	millisats := ctx.Int64("amt")
-	for millisats < minSendable || millisats > maxSendable {
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Printf("Enter an amount (in millisatoshis) between "+
-			"%d and %d\n", minSendable, maxSendable)
-
-		userInput, err := reader.ReadString('\n')
-		if err != nil {
-			return fmt.Errorf("could not read from console: %w",
-				err)
-		}
-		userInput = strings.TrimSpace(userInput)
-
-		millisats, err = strconv.ParseInt(userInput, 10, 64)
-		if err != nil {
-			fmt.Printf("error parsing input: %v", err)
-			continue
-		}
-
-		if millisats < minSendable || millisats > maxSendable {
-			fmt.Printf("Invalid amount. Expected an amount "+
-				"between %d and %d, got %d\n", minSendable,
-				maxSendable, millisats)
-		}
-	}
-
-	delim := "?"
-	if strings.Contains(payResp.Callback, "?") {
-		delim = "&"
-	}
-
-	getInvoice := fmt.Sprintf(
-		"%s%samount=%d", payResp.Callback, delim, 2000,
+	millisats, err := promptAmount(
+		ctx.Int64("amt"), payResp.MinSendable, payResp.MaxSendable,
 	)
-
-	var invoice lndurl.InvoiceResponse
-	if err := get(getInvoice, &invoice); err != nil {
+	if err != nil {
 		return err
 	}
 
-	inv, err := zpay32.Decode(
-		invoice.PayRequest, &chaincfg.RegressionNetParams,
+	invoice, err := c.RequestInvoice(
+		ctx.Context, payResp, &client.InvoiceRequest{
+			AmountMsat: millisats,
+			Comment:    ctx.String("comment"),
+		},
 	)
 	if err != nil {
 		return err
 	}
 
-	// Ensure that the invoice description hash matches the metadata
-	// received before.
-	hash := sha256.Sum256([]byte(meta))
-	if !bytes.Equal(inv.DescriptionHash[:], hash[:]) {
-		return fmt.Errorf("invalid invoice description hash")
-	}
-
 	lndClient, err := getLND(ctx)
 	if err != nil {
 		return fmt.Errorf("could not connect to LND: %w", err)
 	}
 
+	// Only pay invoices for the requested amount on our node's network.
+	params, err := chainParams(ctx, lndClient)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.VerifyInvoice(invoice, params)
+	if err != nil {
+		return err
+	}
+
 	res := <-lndClient.Client.PayInvoice(
 		ctx.Context, invoice.PayRequest,
 		btcutil.Amount(ctx.Int64("maxfee")), nil,
@@ -193,5 +120,34 @@ func payToLNURL(ctx *cli.Context) error {
 
 	fmt.Printf("Successful payment! Preimage: %s\n", res.Preimage)
 
+	if invoice.SuccessAction == nil {
+		return nil
+	}
+
+	return showSuccessAction(invoice.SuccessAction, res.Preimage)
+}
+
+// showSuccessAction prints the success action returned by LN SERVICE,
+// decrypting it with the payment preimage if required.
+func showSuccessAction(action *lndurl.SuccessAction,
+	preimage lntypes.Preimage) error {
+
+	switch action.Tag {
+	case lndurl.SuccessActionMessage:
+		fmt.Printf("Message from LN SERVICE: %s\n", action.Message)
+
+	case lndurl.SuccessActionURL:
+		fmt.Printf("%s\nOpen: %s\n", action.Description, action.URL)
+
+	case lndurl.SuccessActionAES:
+		plaintext, err := action.Decrypt(preimage)
+		if err != nil {
+			return fmt.Errorf("could not decrypt success action: %w",
+				err)
+		}
+
+		fmt.Printf("%s\n%s\n", action.Description, plaintext)
+	}
+
 	return nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ellemouton/lndurl"
+	"github.com/ellemouton/lndurl/client"
+
+	"github.com/lightningnetwork/lnd/channeldb"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/urfave/cli/v2"
+)
+
+var withdrawCommand = &cli.Command{
+	Name:        "withdraw",
+	Usage:       "Withdraw from an LNURL",
+	Description: `Redeem an LNURL-withdraw code into the connected node`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "lnurl",
+			Usage: "The LNURL to withdraw from.",
+		},
+		&cli.Int64Flag{
+			Name:  "amt",
+			Usage: "The amt of millisats to withdraw",
+		},
+		&cli.StringFlag{
+			Name: "memo",
+			Usage: "The memo to use for the invoice. Defaults to " +
+				"the description provided by the service",
+		},
+		&cli.DurationFlag{
+			Name: "timeout",
+			Usage: "how long to wait for the service to pay the " +
+				"invoice",
+			Value: time.Minute,
+		},
+		&cli.BoolFlag{
+			Name:  "notls",
+			Usage: "set to true to use http instead of https",
+		},
+	},
+	Action: withdrawFromLNURL,
+}
+
+func withdrawFromLNURL(ctx *cli.Context) error {
+	// LNURL must be specified.
+	lnurl := ctx.String("lnurl")
+	if lnurl == "" {
+		return fmt.Errorf("missing '--lnurl' flag")
+	}
+
+	c := client.New(&client.Config{
+		AllowHTTP: ctx.Bool("notls"),
+	})
+
+	withdrawURL, err := c.ResolveURL(lnurl, client.SchemeWithdraw)
+	if err != nil {
+		return err
+	}
+
+	// Make a GET request to the decoded LNURL.
+	var withdrawResp lndurl.WithdrawResponse
+	if err := get(withdrawURL, &withdrawResp); err != nil {
+		return err
+	}
+
+	if withdrawResp.Tag != lndurl.TypeWithdrawRequest {
+		return fmt.Errorf("expected a '%s' LNURL, got '%s'",
+			lndurl.TypeWithdrawRequest, withdrawResp.Tag)
+	}
+
+	millisats, err := promptAmount(
+		ctx.Int64("amt"), withdrawResp.MinWithdrawable,
+		withdrawResp.MaxWithdrawable,
+	)
+	if err != nil {
+		return err
+	}
+
+	memo := ctx.String("memo")
+	if memo == "" {
+		memo = withdrawResp.DefaultDescription
+	}
+
+	lndClient, err := getLND(ctx)
+	if err != nil {
+		return fmt.Errorf("could not connect to LND: %w", err)
+	}
+	defer lndClient.Close()
+
+	hash, pr, err := lndClient.Client.AddInvoice(
+		ctx.Context, &invoicesrpc.AddInvoiceData{
+			Memo:  memo,
+			Value: lnwire.MilliSatoshi(millisats),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("could not create invoice: %w", err)
+	}
+
+	// Subscribe to the invoice before handing it to the service so that
+	// we can't miss the settlement.
+	subCtx, cancel := context.WithTimeout(
+		ctx.Context, ctx.Duration("timeout"),
+	)
+	defer cancel()
+
+	updates, errChan, err := lndClient.Invoices.SubscribeSingleInvoice(
+		subCtx, hash,
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to invoice: %w", err)
+	}
+
+	delim := "?"
+	if strings.Contains(withdrawResp.Callback, "?") {
+		delim = "&"
+	}
+
+	callback := fmt.Sprintf(
+		"%s%sk1=%s&pr=%s", withdrawResp.Callback, delim,
+		url.QueryEscape(withdrawResp.K1), url.QueryEscape(pr),
+	)
+
+	var status lndurl.StatusResponse
+	if err := get(callback, &status); err != nil {
+		return err
+	}
+
+	if status.Status != lndurl.StatusOK {
+		return fmt.Errorf("unexpected status from LN SERVICE: %s",
+			status.Status)
+	}
+
+	fmt.Printf("Invoice accepted by LN SERVICE, waiting for payment of "+
+		"%d msat...\n", millisats)
+
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("invoice subscription closed")
+			}
+
+			switch update.State {
+			case channeldb.ContractSettled:
+				fmt.Printf("Successful withdrawal! Received %v\n",
+					update.AmtPaid)
+
+				return nil
+
+			case channeldb.ContractCanceled:
+				return fmt.Errorf("invoice was canceled")
+			}
+
+		case err := <-errChan:
+			return fmt.Errorf("invoice subscription error: %w", err)
+
+		case <-subCtx.Done():
+			return fmt.Errorf("timed out waiting for withdrawal " +
+				"payment")
+		}
+	}
+}
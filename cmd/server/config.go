@@ -0,0 +1,553 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/ellemouton/lndurl"
+	"github.com/lightninglabs/lndclient"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// envPrefix is the prefix of the environment variables that override
+	// the config file.
+	envPrefix = "LNDURL_"
+
+	// defaultLndAddr is the default address of lnd's RPC server.
+	defaultLndAddr = "localhost:10009"
+
+	// backendLnd and backendCln are the supported lightning backends.
+	backendLnd = "lnd"
+	backendCln = "cln"
+
+	// defaultMinSendable and defaultMaxSendable are the default bounds
+	// of the amount that can be paid, in millisatoshis.
+	defaultMinSendable = 1000
+	defaultMaxSendable = 100000000
+)
+
+var (
+	// lndurlDir is the default directory of the config file and the
+	// database.
+	lndurlDir = btcutil.AppDataDir("lndurl", false)
+
+	// lndDir is the default lnd directory.
+	lndDir = btcutil.AppDataDir("lnd", false)
+
+	// clnDir is the default Core Lightning directory.
+	clnDir = btcutil.AppDataDir("lightning", false)
+
+	// defaultConfigFile is the config file that is loaded if no other
+	// file is given.
+	defaultConfigFile = filepath.Join(lndurlDir, "lndurl.yaml")
+)
+
+// envVars returns the environment variable that overrides the given option.
+func envVars(name string) []string {
+	return []string{
+		envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_")),
+	}
+}
+
+// serverFlags returns the flags of the server. Flags remember whether they
+// were set, so every app needs its own.
+func serverFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name: "configfile",
+			Usage: "path to a YAML config file with the same " +
+				"keys as the long flag names",
+			Value:   defaultConfigFile,
+			EnvVars: envVars("configfile"),
+		},
+		&cli.StringFlag{
+			Name:    "network",
+			Usage:   "the network lnd is running on",
+			Value:   string(lndclient.NetworkMainnet),
+			EnvVars: envVars("network"),
+		},
+		&cli.StringFlag{
+			Name: "protocol",
+			Usage: "the protocol used in the LNURLs, defaults to " +
+				"https on mainnet and testnet and to http " +
+				"otherwise",
+			EnvVars: envVars("protocol"),
+		},
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "the public host name used in the LNURLs",
+			Value:   "localhost",
+			EnvVars: envVars("host"),
+		},
+		&cli.IntFlag{
+			Name: "port",
+			Usage: "the public port used in the LNURLs, defaults " +
+				"to 443 for https and to 8080 for http",
+			EnvVars: envVars("port"),
+		},
+		&cli.StringFlag{
+			Name: "listen-addr",
+			Usage: "the host:port or unix://<path> socket that " +
+				"the server listens on, defaults to the " +
+				"public port on all interfaces",
+			EnvVars: envVars("listen-addr"),
+		},
+		&cli.StringFlag{
+			Name: "tls-cert-path",
+			Usage: "path to the tls cert used to serve https, " +
+				"plain http is served if not set",
+			EnvVars: envVars("tls-cert-path"),
+		},
+		&cli.StringFlag{
+			Name:    "tls-key-path",
+			Usage:   "path to the key of the tls cert",
+			EnvVars: envVars("tls-key-path"),
+		},
+		&cli.BoolFlag{
+			Name: "tls-self-signed",
+			Usage: "generate a self-signed tls cert if none " +
+				"exists, defaults to tls.cert and tls.key in " +
+				"the lndurl dir",
+			EnvVars: envVars("tls-self-signed"),
+		},
+		&cli.StringFlag{
+			Name: "username",
+			Usage: "the username of the single Lightning Address " +
+				"that is served if no users file is given",
+			EnvVars: envVars("username"),
+		},
+		&cli.StringFlag{
+			Name:    "users-file",
+			Usage:   "path to a JSON file holding the served users",
+			EnvVars: envVars("users-file"),
+		},
+		&cli.StringFlag{
+			Name: "description",
+			Usage: "the payment description shown to payers of " +
+				"the static pay code and of users without " +
+				"their own",
+			EnvVars: envVars("description"),
+		},
+		&cli.StringFlag{
+			Name: "long-description",
+			Usage: "a longer description that wallets may show " +
+				"along with the payment description",
+			EnvVars: envVars("long-description"),
+		},
+		&cli.StringFlag{
+			Name: "avatar",
+			Usage: "path to a PNG or JPEG image shown to payers, " +
+				"at most 128 KiB",
+			EnvVars: envVars("avatar"),
+		},
+		&cli.StringFlag{
+			Name:    "backend",
+			Usage:   "the lightning node to use, either lnd or cln",
+			Value:   backendLnd,
+			EnvVars: envVars("backend"),
+		},
+		&cli.StringFlag{
+			Name:    "lnd-addr",
+			Usage:   "lnd instance rpc address",
+			Value:   defaultLndAddr,
+			EnvVars: envVars("lnd-addr"),
+		},
+		&cli.StringFlag{
+			Name: "lnd-macaroon-dir",
+			Usage: "path to lnd's macaroon dir, defaults to the " +
+				"dir of the selected network",
+			EnvVars: envVars("lnd-macaroon-dir"),
+		},
+		&cli.StringFlag{
+			Name:    "lnd-tls-path",
+			Usage:   "path to lnd's tls cert",
+			Value:   filepath.Join(lndDir, "tls.cert"),
+			EnvVars: envVars("lnd-tls-path"),
+		},
+		&cli.StringFlag{
+			Name: "cln-rpc-path",
+			Usage: "path to the JSON-RPC socket of Core " +
+				"Lightning, defaults to lightning-rpc in the " +
+				"dir of the selected network",
+			EnvVars: envVars("cln-rpc-path"),
+		},
+		&cli.Int64Flag{
+			Name:    "min-sendable",
+			Usage:   "the min amount (in msat) that can be paid",
+			Value:   defaultMinSendable,
+			EnvVars: envVars("min-sendable"),
+		},
+		&cli.Int64Flag{
+			Name:    "max-sendable",
+			Usage:   "the max amount (in msat) that can be paid",
+			Value:   defaultMaxSendable,
+			EnvVars: envVars("max-sendable"),
+		},
+		&cli.Int64Flag{
+			Name: "min-withdrawable",
+			Usage: "the min amount (in msat) of a single " +
+				"withdrawal",
+			EnvVars: envVars("min-withdrawable"),
+		},
+		&cli.Int64Flag{
+			Name: "max-withdrawable",
+			Usage: "the max amount (in msat) of a single " +
+				"withdrawal, only the budget of the link " +
+				"limits it if zero",
+			EnvVars: envVars("max-withdrawable"),
+		},
+		&cli.Int64Flag{
+			Name: "withdraw-budget",
+			Usage: "the total amount (in msat) that the default " +
+				"withdraw link may pay out, no link is " +
+				"created if zero",
+			EnvVars: envVars("withdraw-budget"),
+		},
+		&cli.Int64Flag{
+			Name: "max-withdraw-fee",
+			Usage: "the max routing fee (in sat) paid for a " +
+				"withdrawal",
+			EnvVars: envVars("max-withdraw-fee"),
+		},
+		&cli.StringFlag{
+			Name: "success-message",
+			Usage: "a message shown to payers once they have " +
+				"paid",
+			EnvVars: envVars("success-message"),
+		},
+		&cli.StringFlag{
+			Name:    "success-url",
+			Usage:   "a URL shown to payers once they have paid",
+			EnvVars: envVars("success-url"),
+		},
+		&cli.StringFlag{
+			Name: "success-secret",
+			Usage: "a secret that payers can only decrypt once " +
+				"they have paid",
+			EnvVars: envVars("success-secret"),
+		},
+		&cli.StringFlag{
+			Name:    "success-description",
+			Usage:   "the description of the success url or secret",
+			EnvVars: envVars("success-description"),
+		},
+		&cli.IntFlag{
+			Name: "comment-allowed",
+			Usage: "the max number of characters of a payer " +
+				"comment, comments are not accepted if zero",
+			EnvVars: envVars("comment-allowed"),
+		},
+		&cli.StringSliceFlag{
+			Name: "payerdata",
+			Usage: "payer data to request in the form " +
+				"<field>[:mandatory], field is one of name, " +
+				"pubkey, identifier, email or auth",
+			EnvVars: envVars("payerdata"),
+		},
+		&cli.StringFlag{
+			Name: "db-path",
+			Usage: "path to the database, defaults to a per " +
+				"network database in the lndurl dir",
+			EnvVars: envVars("db-path"),
+		},
+		&cli.DurationFlag{
+			Name:    "metadata-expiry",
+			Usage:   "how long a payer has to request an invoice",
+			Value:   lndurl.DefaultMetadataExpiry,
+			EnvVars: envVars("metadata-expiry"),
+		},
+		&cli.IntFlag{
+			Name:    "max-pending-metadata",
+			Usage:   "the max number of outstanding pay requests",
+			Value:   lndurl.DefaultMaxPendingMetadata,
+			EnvVars: envVars("max-pending-metadata"),
+		},
+		&cli.StringFlag{
+			Name: "callback-secret",
+			Usage: "a secret of at least 32 characters shared by " +
+				"all replicas, enables fixed metadata and " +
+				"stateless callbacks",
+			EnvVars: envVars("callback-secret"),
+		},
+		&cli.Float64Flag{
+			Name: "perip-rate",
+			Usage: "requests per second allowed per client IP, " +
+				"disabled if zero",
+			EnvVars: envVars("perip-rate"),
+		},
+		&cli.IntFlag{
+			Name:    "perip-burst",
+			Usage:   "the burst of requests allowed per client IP",
+			EnvVars: envVars("perip-burst"),
+		},
+		&cli.Float64Flag{
+			Name: "invoice-rate",
+			Usage: "invoices per second created across all " +
+				"clients, disabled if zero",
+			EnvVars: envVars("invoice-rate"),
+		},
+		&cli.IntFlag{
+			Name: "invoice-burst",
+			Usage: "the burst of invoices allowed across all " +
+				"clients",
+			EnvVars: envVars("invoice-burst"),
+		},
+		&cli.StringSliceFlag{
+			Name: "trusted-proxies",
+			Usage: "IPs or CIDRs of reverse proxies whose " +
+				"X-Forwarded-For header is trusted",
+			EnvVars: envVars("trusted-proxies"),
+		},
+		&cli.StringSliceFlag{
+			Name: "webhook",
+			Usage: "an endpoint notified about settled invoices " +
+				"in the form <url>[#<secret>]",
+			EnvVars: envVars("webhook"),
+		},
+		&cli.StringFlag{
+			Name: "webhook-spool-dir",
+			Usage: "the dir that undelivered webhook events are " +
+				"saved to",
+			EnvVars: envVars("webhook-spool-dir"),
+		},
+	}
+}
+
+// loadConfigFile applies the options of the config file to all flags that
+// were not set on the command line or through the environment. A missing
+// default config file is ignored.
+func loadConfigFile(ctx *cli.Context) error {
+	path := ctx.String("configfile")
+
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !ctx.IsSet("configfile") {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	var options map[string]interface{}
+	if err := yaml.Unmarshal(b, &options); err != nil {
+		return fmt.Errorf("could not parse config file: %w", err)
+	}
+
+	known := make(map[string]bool)
+	for _, flag := range ctx.App.Flags {
+		for _, name := range flag.Names() {
+			known[name] = true
+		}
+	}
+
+	for name, value := range options {
+		if !known[name] || name == "configfile" {
+			return fmt.Errorf("unknown option '%s' in config file",
+				name)
+		}
+
+		// Flags and environment variables take precedence.
+		if ctx.IsSet(name) {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+
+		for _, v := range values {
+			if _, ok := v.(map[interface{}]interface{}); ok {
+				return fmt.Errorf("invalid value for option "+
+					"'%s' in config file", name)
+			}
+
+			if err := ctx.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("invalid value for option "+
+					"'%s' in config file: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configFromContext builds the server config from the parsed flags, filling in
+// the defaults of the selected network.
+func configFromContext(ctx *cli.Context) (*lndurl.Config, error) {
+	network := lndclient.Network(ctx.String("network"))
+
+	cfg := &lndurl.Config{
+		Protocol:            ctx.String("protocol"),
+		Username:            ctx.String("username"),
+		Host:                ctx.String("host"),
+		Port:                ctx.Int("port"),
+		ListenAddr:          ctx.String("listen-addr"),
+		TLSCertPath:         ctx.String("tls-cert-path"),
+		TLSKeyPath:          ctx.String("tls-key-path"),
+		TLSSelfSigned:       ctx.Bool("tls-self-signed"),
+		LndAddr:             ctx.String("lnd-addr"),
+		Network:             network,
+		MacaroonDir:         ctx.String("lnd-macaroon-dir"),
+		TLSPath:             ctx.String("lnd-tls-path"),
+		MinMsatSendable:     ctx.Int64("min-sendable"),
+		MaxMsatSendable:     ctx.Int64("max-sendable"),
+		MinMsatWithdrawable: ctx.Int64("min-withdrawable"),
+		MaxMsatWithdrawable: ctx.Int64("max-withdrawable"),
+		WithdrawBudget:      ctx.Int64("withdraw-budget"),
+		MaxWithdrawFeeSat:   ctx.Int64("max-withdraw-fee"),
+		Description:         ctx.String("description"),
+		LongDescription:     ctx.String("long-description"),
+		Avatar:              ctx.String("avatar"),
+		SuccessMessage:      ctx.String("success-message"),
+		SuccessURL:          ctx.String("success-url"),
+		SuccessSecret:       ctx.String("success-secret"),
+		SuccessDescription:  ctx.String("success-description"),
+		CommentAllowed:      ctx.Int("comment-allowed"),
+		DBPath:              ctx.String("db-path"),
+		MetadataExpiry:      ctx.Duration("metadata-expiry"),
+		MaxPendingMetadata:  ctx.Int("max-pending-metadata"),
+		CallbackSecret:      ctx.String("callback-secret"),
+		PerIPRate:           ctx.Float64("perip-rate"),
+		PerIPBurst:          ctx.Int("perip-burst"),
+		InvoiceRate:         ctx.Float64("invoice-rate"),
+		InvoiceBurst:        ctx.Int("invoice-burst"),
+		TrustedProxies:      ctx.StringSlice("trusted-proxies"),
+		UsersFile:           ctx.String("users-file"),
+		WebhookSpoolDir:     ctx.String("webhook-spool-dir"),
+	}
+
+	if cfg.Protocol == "" {
+		cfg.Protocol = "http"
+		if network == lndclient.NetworkMainnet ||
+			network == lndclient.NetworkTestnet {
+
+			cfg.Protocol = "https"
+		}
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = 8080
+		if cfg.Protocol == "https" {
+			cfg.Port = 443
+		}
+	}
+
+	switch ctx.String("backend") {
+	case backendLnd:
+		if cfg.MacaroonDir == "" {
+			cfg.MacaroonDir = filepath.Join(
+				lndDir, "data", "chain", "bitcoin",
+				string(network),
+			)
+		}
+
+	case backendCln:
+		cfg.LndAddr, cfg.MacaroonDir, cfg.TLSPath = "", "", ""
+
+		cfg.ClnRPCPath = ctx.String("cln-rpc-path")
+		if cfg.ClnRPCPath == "" {
+			// Core Lightning calls mainnet "bitcoin".
+			clnNetwork := string(network)
+			if network == lndclient.NetworkMainnet {
+				clnNetwork = "bitcoin"
+			}
+
+			cfg.ClnRPCPath = filepath.Join(
+				clnDir, clnNetwork, "lightning-rpc",
+			)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown backend '%s'",
+			ctx.String("backend"))
+	}
+
+	if cfg.TLSSelfSigned {
+		if cfg.TLSCertPath == "" {
+			cfg.TLSCertPath = filepath.Join(lndurlDir, "tls.cert")
+		}
+		if cfg.TLSKeyPath == "" {
+			cfg.TLSKeyPath = filepath.Join(lndurlDir, "tls.key")
+		}
+	}
+
+	if cfg.DBPath == "" {
+		cfg.DBPath = filepath.Join(
+			lndurlDir, string(network), "lndurl.db",
+		)
+	}
+
+	var err error
+	cfg.PayerData, err = parsePayerData(ctx.StringSlice("payerdata"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, webhook := range ctx.StringSlice("webhook") {
+		url, secret := webhook, ""
+		if i := strings.LastIndex(webhook, "#"); i != -1 {
+			url, secret = webhook[:i], webhook[i+1:]
+		}
+
+		cfg.Webhooks = append(cfg.Webhooks, &lndurl.WebhookEndpoint{
+			URL:    url,
+			Secret: secret,
+		})
+	}
+
+	return cfg, nil
+}
+
+// parsePayerData parses the requested payer data fields. Each field is of the
+// form <field>[:mandatory]. Nil is returned if no fields are requested.
+func parsePayerData(fields []string) (*lndurl.PayerDataSpec, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	var spec lndurl.PayerDataSpec
+	for _, field := range fields {
+		parts := strings.SplitN(field, ":", 2)
+
+		var mandatory bool
+		if len(parts) == 2 {
+			if parts[1] != "mandatory" {
+				return nil, fmt.Errorf("invalid payer data "+
+					"field '%s'", field)
+			}
+			mandatory = true
+		}
+
+		f := &lndurl.PayerDataField{Mandatory: mandatory}
+		switch parts[0] {
+		case "name":
+			spec.Name = f
+
+		case "pubkey":
+			spec.Pubkey = f
+
+		case "identifier":
+			spec.Identifier = f
+
+		case "email":
+			spec.Email = f
+
+		case "auth":
+			spec.Auth = &lndurl.PayerDataAuthField{
+				Mandatory: mandatory,
+			}
+
+		default:
+			return nil, fmt.Errorf("unknown payer data field '%s'",
+				parts[0])
+		}
+	}
+
+	return &spec, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ellemouton/lndurl"
+	"github.com/lightninglabs/lndclient"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// parseConfig runs the server app with the given config file content and
+// arguments and returns the resulting config.
+func parseConfig(t *testing.T, configFile string,
+	args ...string) (*lndurl.Config, error) {
+
+	path := filepath.Join(t.TempDir(), "lndurl.yaml")
+	err := ioutil.WriteFile(path, []byte(configFile), 0600)
+	require.NoError(t, err)
+
+	var cfg *lndurl.Config
+	app := cli.NewApp()
+	app.Flags = serverFlags()
+	app.Before = loadConfigFile
+	app.Action = func(ctx *cli.Context) error {
+		var err error
+		cfg, err = configFromContext(ctx)
+
+		return err
+	}
+
+	args = append([]string{"lndurl-server", "--configfile", path}, args...)
+	if err := app.Run(args); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// TestConfigPrecedence tests that flags take precedence over the environment
+// and the environment over the config file.
+func TestConfigPrecedence(t *testing.T) {
+	const configFile = `
+host: file.com
+username: file
+payerdata:
+  - name
+  - email:mandatory
+`
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		host     string
+		username string
+	}{
+		{
+			name:     "config file",
+			host:     "file.com",
+			username: "file",
+		},
+		{
+			name:     "env overrides config file",
+			env:      map[string]string{"LNDURL_HOST": "env.com"},
+			host:     "env.com",
+			username: "file",
+		},
+		{
+			name:     "flag overrides env and config file",
+			env:      map[string]string{"LNDURL_HOST": "env.com"},
+			args:     []string{"--host", "flag.com"},
+			host:     "flag.com",
+			username: "file",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := parseConfig(t, configFile, test.args...)
+			require.NoError(t, err)
+			require.Equal(t, test.host, cfg.Host)
+			require.Equal(t, test.username, cfg.Username)
+
+			// Lists in the config file set slice options.
+			require.NotNil(t, cfg.PayerData)
+			require.False(t, cfg.PayerData.Name.Mandatory)
+			require.True(t, cfg.PayerData.Email.Mandatory)
+		})
+	}
+}
+
+// TestConfigDefaults tests the defaults of the selected network and that
+// invalid config files are rejected.
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := parseConfig(t, "")
+	require.NoError(t, err)
+	require.Equal(t, lndclient.NetworkMainnet, cfg.Network)
+	require.Equal(t, "https", cfg.Protocol)
+	require.Equal(t, 443, cfg.Port)
+
+	// Mainnet defaults to https, which can't be served without a tls
+	// cert unless a reverse proxy terminates tls.
+	require.Error(t, cfg.Validate())
+
+	cfg, err = parseConfig(t, "network: regtest\nbackend: cln\n")
+	require.NoError(t, err)
+	require.Equal(t, "http", cfg.Protocol)
+	require.Equal(t, 8080, cfg.Port)
+	require.Empty(t, cfg.LndAddr)
+	require.Equal(
+		t, filepath.Join(clnDir, "regtest", "lightning-rpc"),
+		cfg.ClnRPCPath,
+	)
+
+	_, err = parseConfig(t, "unknown: value\n")
+	require.Error(t, err)
+
+	_, err = parseConfig(t, "description:\n  nested: value\n")
+	require.Error(t, err)
+}
+
+// TestWithdrawDefaults tests that the default withdraw link of a server that
+// only sets a withdraw budget can be withdrawn from.
+func TestWithdrawDefaults(t *testing.T) {
+	dir := t.TempDir()
+	rpcPath := filepath.Join(dir, "lightning-rpc")
+	require.NoError(t, ioutil.WriteFile(rpcPath, nil, 0600))
+
+	cfg, err := parseConfig(
+		t, "", "--network", "regtest", "--backend", "cln",
+		"--cln-rpc-path", rpcPath,
+		"--db-path", filepath.Join(dir, "lndurl.db"),
+		"--withdraw-budget", "20000",
+	)
+	require.NoError(t, err)
+
+	backend, err := lndurl.NewFakeBackend(&chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+
+	server, err := lndurl.NewServer(cfg, backend)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, server.Stop())
+	}()
+
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	link, err := lndurl.DecodeURL(server.DefaultWithdrawLink())
+	require.NoError(t, err)
+	linkURL, err := url.Parse(link)
+	require.NoError(t, err)
+
+	resp, err := http.Get(
+		httpServer.URL + linkURL.Path + "?" + linkURL.RawQuery,
+	)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var withdrawResp lndurl.WithdrawResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&withdrawResp))
+	require.EqualValues(t, 20000, withdrawResp.MaxWithdrawable)
+}
@@ -1,28 +1,84 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/ellemouton/lndurl"
-	"github.com/lightninglabs/lndclient"
+	"github.com/urfave/cli/v2"
 )
 
 func main() {
-	server, err := lndurl.NewServer(&lndurl.Config{
-		Username:        "elle",
-		Protocol:        "http",
-		Host:            "localhost",
-		Port:            8080,
-		LndAddr:         "localhost:10011",
-		Network:         lndclient.NetworkRegtest,
-		MacaroonDir:     "/Users/elle/LL/dev-resources/docker-regtest/mounts/regtest/alice",
-		TLSPath:         "/Users/elle/LL/dev-resources/docker-regtest/mounts/regtest/alice/tls.cert",
-		MaxMsatSendable: 20000,
-		MinMsatSendable: 100,
-	})
+	app := cli.NewApp()
+
+	app.Name = "lndurl-server"
+	app.Usage = "LNURL server backed by lnd"
+	app.Description = "Options are read from the config file, the " +
+		"environment (" + envPrefix + "<FLAG_NAME>) and the command " +
+		"line. Later sources take precedence."
+	app.Flags = serverFlags()
+	app.Before = loadConfigFile
+	app.Action = run
+
+	err := app.Run(os.Args)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "[lndurl-server] %v\n", err)
+	os.Exit(1)
+}
+
+func run(ctx *cli.Context) error {
+	cfg, err := configFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The database is created on first start, but its directory must
+	// exist.
+	if err := os.MkdirAll(filepath.Dir(cfg.DBPath), 0700); err != nil {
+		return err
+	}
+
+	backend, err := newBackend(cfg)
+	if err != nil {
+		return err
+	}
+
+	server, err := lndurl.NewServer(cfg, backend)
 	if err != nil {
-		log.Fatalln(err)
+		backend.Close()
+		return err
+	}
+
+	// Shut down cleanly when the service manager asks us to stop.
+	sigCtx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+
+	if err := server.Run(sigCtx); err != nil {
+		return err
+	}
+
+	log.Print("Server stopped")
+
+	return nil
+}
+
+// newBackend connects to the lightning node selected in the config.
+func newBackend(cfg *lndurl.Config) (lndurl.Backend, error) {
+	if cfg.ClnRPCPath != "" {
+		return lndurl.NewClnBackend(cfg.ClnRPCPath)
 	}
 
-	log.Fatalln(server.Run())
+	return lndurl.NewLndBackend(cfg)
 }
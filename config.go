@@ -0,0 +1,369 @@
+package lndurl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/lndclient"
+)
+
+// unixSocketPrefix is the prefix of listen addresses that are unix sockets.
+const unixSocketPrefix = "unix://"
+
+// Config holds the settings of the server.
+type Config struct {
+	Protocol string
+	Username string
+	Host     string
+	Port     int
+
+	// ListenAddr is the address that the HTTP server listens on. It is
+	// either a host:port pair or the path of a unix socket prefixed with
+	// unix://. Protocol, Host and Port only make up the public URL, which
+	// differs from the listen address if the server runs behind a
+	// reverse proxy. If empty, the server listens on Port on all
+	// interfaces.
+	ListenAddr string
+
+	// TLSCertPath and TLSKeyPath are the certificate and key used to
+	// serve HTTPS. If both are empty, plain HTTP is served, which
+	// requires a ListenAddr behind a reverse proxy if Protocol is https.
+	// The files are reloaded when they change on disk.
+	TLSCertPath string
+	TLSKeyPath  string
+
+	// TLSSelfSigned generates a self-signed certificate for Host at
+	// TLSCertPath and TLSKeyPath if they don't exist yet. It is meant for
+	// regtest and development setups.
+	TLSSelfSigned bool
+
+	// Network is the network that the node runs on.
+	Network lndclient.Network
+
+	// LndAddr, MacaroonDir and TLSPath configure the connection that
+	// NewLndBackend makes to LND.
+	LndAddr     string
+	MacaroonDir string
+	TLSPath     string
+
+	// ClnRPCPath is the path to the JSON-RPC unix socket of a Core
+	// Lightning node that NewClnBackend connects to. It can't be used
+	// together with LndAddr.
+	ClnRPCPath string
+
+	MinMsatSendable int64
+	MaxMsatSendable int64
+
+	// MinMsatWithdrawable and MaxMsatWithdrawable bound the amount that
+	// can be withdrawn in a single LNURL-withdraw request. If
+	// MaxMsatWithdrawable is zero, only the budget of a link limits it.
+	MinMsatWithdrawable int64
+	MaxMsatWithdrawable int64
+
+	// WithdrawBudget is the total number of millisats that the default
+	// withdraw link may pay out over its lifetime. If zero, no default
+	// withdraw link is created. The link and its remaining budget are
+	// kept in the store, so the budget only applies when the link is
+	// first created.
+	WithdrawBudget int64
+
+	// MaxWithdrawFeeSat is the maximum routing fee (in sats) that we are
+	// willing to pay when paying out a withdraw invoice. The fee is
+	// deducted from the link's budget.
+	MaxWithdrawFeeSat int64
+
+	// Description, LongDescription and Avatar make up the metadata that
+	// is shown to payers of the static pay code. They are also used for
+	// users that don't set their own. If Description is empty, a random
+	// string is shown. Avatar is the path to a PNG or JPEG image of at
+	// most MaxAvatarSize bytes.
+	Description     string
+	LongDescription string
+	Avatar          string
+
+	// SuccessMessage, SuccessURL and SuccessSecret configure the success
+	// action that is returned along with invoices. At most one of them
+	// should be set. If SuccessSecret is set, it is encrypted with the
+	// invoice preimage so that the payer can only read it once it has
+	// paid. SuccessDescription accompanies the url and secret actions.
+	SuccessMessage     string
+	SuccessURL         string
+	SuccessSecret      string
+	SuccessDescription string
+
+	// CommentAllowed is the max number of characters that a payer may
+	// include as a comment with their payment. Comments are not accepted
+	// if zero.
+	CommentAllowed int
+
+	// PayerData declares the data that payers are asked to provide about
+	// themselves. If Auth is set, a fresh k1 is generated for each pay
+	// request.
+	PayerData *PayerDataSpec
+
+	// DBPath is the path to the bbolt database used to persist payment
+	// metadata and issued invoices. If empty, state is only kept in
+	// memory and is lost on restart.
+	DBPath string
+
+	// MetadataExpiry is how long a payer has to call the callback after
+	// requesting the pay parameters. Expired metadata is periodically
+	// removed. Defaults to DefaultMetadataExpiry.
+	MetadataExpiry time.Duration
+
+	// CallbackSecret enables stateless callbacks. If set, the metadata of
+	// the static pay code and of each Lightning Address is fixed and
+	// callback ids are tokens, authenticated with this secret, that
+	// encode the user and the expiry. Nothing is stored until an invoice
+	// is created, and a callback can be called until it expires. Servers
+	// sharing the secret can serve each other's callbacks, so several
+	// replicas can run behind a load balancer. It must be at least 32
+	// characters long. As a callback id can be used more than once, it
+	// can't be combined with PayerData.Auth, whose challenges must only
+	// be answered once.
+	CallbackSecret string
+
+	// MaxPendingMetadata is the max number of outstanding pay requests.
+	// Once reached, new pay requests are rejected until older ones have
+	// been used or have expired. Defaults to DefaultMaxPendingMetadata.
+	MaxPendingMetadata int
+
+	// PerIPRate is the number of requests per second that a single client
+	// IP may make, with bursts of up to PerIPBurst requests. Per IP
+	// limiting is disabled if zero.
+	PerIPRate  float64
+	PerIPBurst int
+
+	// InvoiceRate is the number of invoices per second that may be
+	// created across all clients, with bursts of up to InvoiceBurst
+	// invoices. Global limiting is disabled if zero.
+	InvoiceRate  float64
+	InvoiceBurst int
+
+	// TrustedProxies is a list of IPs or CIDRs of reverse proxies whose
+	// X-Forwarded-For header is used to determine the client IP.
+	TrustedProxies []string
+
+	// Users is the registry of Lightning Addresses served under
+	// /.well-known/lnurlp/<username>. If nil, the users are loaded from
+	// UsersFile or, if that is empty too, a single user is created from
+	// Username.
+	Users UserRegistry
+
+	// UsersFile is the path to a JSON file holding an array of users.
+	UsersFile string
+
+	// Webhooks are the endpoints that are notified about settled
+	// invoices.
+	Webhooks []*WebhookEndpoint
+
+	// WebhookSpoolDir is the directory that undelivered webhook events
+	// are saved to. It defaults to a "webhooks" directory next to the
+	// database. If both are empty, undelivered events are lost on
+	// restart.
+	WebhookSpoolDir string
+}
+
+// Validate checks that the config is consistent and that the files it refers
+// to exist. Zero values that have a default are accepted.
+func (c *Config) Validate() error {
+	if c.Protocol != "http" && c.Protocol != "https" {
+		return fmt.Errorf("invalid protocol '%s': expected http or "+
+			"https", c.Protocol)
+	}
+
+	if c.Host == "" {
+		return errors.New("host must be set")
+	}
+
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+
+	if c.ListenAddr != "" {
+		if _, _, err := parseListenAddr(c.ListenAddr); err != nil {
+			return err
+		}
+	}
+
+	if (c.TLSCertPath == "") != (c.TLSKeyPath == "") {
+		return errors.New("tls cert and key must be set together")
+	}
+
+	// Without a listen address the server is reached directly, so it
+	// must serve https itself if the URLs say so.
+	if c.Protocol == "https" && c.TLSCertPath == "" &&
+		c.ListenAddr == "" {
+
+		return errors.New("tls cert must be set to serve https, or " +
+			"listen addr if a reverse proxy terminates tls")
+	}
+
+	if c.TLSSelfSigned && c.TLSCertPath == "" {
+		return errors.New("tls cert and key paths must be set to " +
+			"generate a self-signed cert")
+	}
+
+	if c.TLSCertPath != "" && !c.TLSSelfSigned {
+		if err := checkPath("tls cert", c.TLSCertPath, false); err != nil {
+			return err
+		}
+		if err := checkPath("tls key", c.TLSKeyPath, false); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.Network.ChainParams(); err != nil {
+		return fmt.Errorf("invalid network '%s'", c.Network)
+	}
+
+	if c.LndAddr != "" && c.ClnRPCPath != "" {
+		return errors.New("lnd address and cln rpc path must not be " +
+			"set together")
+	}
+
+	// The LND settings are only used if the server is backed by LND.
+	if c.LndAddr != "" {
+		err := checkPath("macaroon dir", c.MacaroonDir, true)
+		if err != nil {
+			return err
+		}
+
+		err = checkPath("lnd tls cert", c.TLSPath, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ClnRPCPath != "" {
+		err := checkPath("cln rpc socket", c.ClnRPCPath, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := checkRange(
+		"sendable", c.MinMsatSendable, c.MaxMsatSendable,
+	); err != nil {
+		return err
+	}
+	if c.MaxMsatSendable == 0 {
+		return errors.New("max sendable must be set")
+	}
+
+	if err := checkRange(
+		"withdrawable", c.MinMsatWithdrawable, c.MaxMsatWithdrawable,
+	); err != nil {
+		return err
+	}
+
+	if c.WithdrawBudget < 0 || c.MaxWithdrawFeeSat < 0 {
+		return errors.New("withdraw budget and max fee must not be " +
+			"negative")
+	}
+
+	if c.Avatar != "" {
+		if err := checkPath("avatar", c.Avatar, false); err != nil {
+			return err
+		}
+	}
+
+	if c.CommentAllowed < 0 {
+		return errors.New("comment allowed must not be negative")
+	}
+
+	if c.MetadataExpiry < 0 || c.MaxPendingMetadata < 0 {
+		return errors.New("metadata expiry and max pending metadata " +
+			"must not be negative")
+	}
+
+	if c.CallbackSecret != "" &&
+		len(c.CallbackSecret) < minCallbackSecretLen {
+
+		return fmt.Errorf("callback secret must be at least %d "+
+			"characters long", minCallbackSecretLen)
+	}
+
+	if c.CallbackSecret != "" && c.PayerData != nil &&
+		c.PayerData.Auth != nil {
+
+		return errors.New("payer data auth can't be requested with " +
+			"a callback secret")
+	}
+
+	if c.PerIPRate < 0 || c.PerIPBurst < 0 || c.InvoiceRate < 0 ||
+		c.InvoiceBurst < 0 {
+
+		return errors.New("rate limits must not be negative")
+	}
+
+	if c.UsersFile != "" {
+		if err := checkPath("users file", c.UsersFile, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRange checks that the min and max amounts of the named range are not
+// negative and that min does not exceed max. A zero max is not checked
+// against.
+func checkRange(name string, min, max int64) error {
+	if min < 0 || max < 0 {
+		return fmt.Errorf("%s amounts must not be negative", name)
+	}
+
+	if max != 0 && min > max {
+		return fmt.Errorf("min %s (%d msat) is greater than max %s "+
+			"(%d msat)", name, min, name, max)
+	}
+
+	return nil
+}
+
+// checkPath checks that the given path exists and is a directory or a regular
+// file, as expected.
+func checkPath(name, path string, dir bool) error {
+	if path == "" {
+		return fmt.Errorf("%s must be set", name)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	if dir && !info.IsDir() {
+		return fmt.Errorf("%s %s is not a directory", name, path)
+	}
+	if !dir && info.IsDir() {
+		return fmt.Errorf("%s %s is a directory", name, path)
+	}
+
+	return nil
+}
+
+// parseListenAddr splits the listen address into the network and the address
+// that are passed to net.Listen.
+func parseListenAddr(listenAddr string) (string, string, error) {
+	if strings.HasPrefix(listenAddr, unixSocketPrefix) {
+		path := strings.TrimPrefix(listenAddr, unixSocketPrefix)
+		if path == "" {
+			return "", "", errors.New("unix socket path must be set")
+		}
+
+		return "unix", path, nil
+	}
+
+	if _, _, err := net.SplitHostPort(listenAddr); err != nil {
+		return "", "", fmt.Errorf("invalid listen address '%s': %w",
+			listenAddr, err)
+	}
+
+	return "tcp", listenAddr, nil
+}
@@ -0,0 +1,176 @@
+package lndurl
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/lndclient"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+
+	tlsPath := filepath.Join(dir, "tls.cert")
+	require.NoError(t, ioutil.WriteFile(tlsPath, []byte("cert"), 0600))
+
+	validConfig := func() *Config {
+		return &Config{
+			Protocol:        "https",
+			Host:            "example.com",
+			Port:            443,
+			ListenAddr:      "localhost:8080",
+			LndAddr:         "localhost:10009",
+			Network:         lndclient.NetworkMainnet,
+			MacaroonDir:     dir,
+			TLSPath:         tlsPath,
+			MinMsatSendable: 1000,
+			MaxMsatSendable: 100000,
+		}
+	}
+	require.NoError(t, validConfig().Validate())
+
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+	}{
+		{
+			name:   "unknown protocol",
+			modify: func(cfg *Config) { cfg.Protocol = "ftp" },
+		},
+		{
+			name:   "no host",
+			modify: func(cfg *Config) { cfg.Host = "" },
+		},
+		{
+			name:   "port out of range",
+			modify: func(cfg *Config) { cfg.Port = 70000 },
+		},
+		{
+			name:   "listen address without port",
+			modify: func(cfg *Config) { cfg.ListenAddr = "localhost" },
+		},
+		{
+			name:   "listen on empty unix socket path",
+			modify: func(cfg *Config) { cfg.ListenAddr = "unix://" },
+		},
+		{
+			name:   "https without tls cert",
+			modify: func(cfg *Config) { cfg.ListenAddr = "" },
+		},
+		{
+			name:   "tls cert without key",
+			modify: func(cfg *Config) { cfg.TLSCertPath = tlsPath },
+		},
+		{
+			name: "missing tls cert",
+			modify: func(cfg *Config) {
+				cfg.TLSCertPath = filepath.Join(dir, "missing")
+				cfg.TLSKeyPath = tlsPath
+			},
+		},
+		{
+			name:   "self-signed without paths",
+			modify: func(cfg *Config) { cfg.TLSSelfSigned = true },
+		},
+		{
+			name:   "unknown network",
+			modify: func(cfg *Config) { cfg.Network = "signet" },
+		},
+		{
+			name: "missing macaroon dir",
+			modify: func(cfg *Config) {
+				cfg.MacaroonDir = filepath.Join(dir, "missing")
+			},
+		},
+		{
+			name:   "tls cert is a directory",
+			modify: func(cfg *Config) { cfg.TLSPath = dir },
+		},
+		{
+			name:   "lnd and cln backend",
+			modify: func(cfg *Config) { cfg.ClnRPCPath = tlsPath },
+		},
+		{
+			name: "missing cln rpc socket",
+			modify: func(cfg *Config) {
+				cfg.LndAddr = ""
+				cfg.ClnRPCPath = filepath.Join(dir, "missing")
+			},
+		},
+		{
+			name:   "min sendable above max",
+			modify: func(cfg *Config) { cfg.MinMsatSendable = 200000 },
+		},
+		{
+			name:   "no max sendable",
+			modify: func(cfg *Config) { cfg.MaxMsatSendable = 0 },
+		},
+		{
+			name: "min withdrawable above max",
+			modify: func(cfg *Config) {
+				cfg.MinMsatWithdrawable = 10
+				cfg.MaxMsatWithdrawable = 5
+			},
+		},
+		{
+			name:   "negative rate",
+			modify: func(cfg *Config) { cfg.PerIPRate = -1 },
+		},
+		{
+			name: "missing users file",
+			modify: func(cfg *Config) {
+				cfg.UsersFile = filepath.Join(dir, "users.json")
+			},
+		},
+		{
+			name: "short callback secret",
+			modify: func(cfg *Config) {
+				cfg.CallbackSecret = "secret"
+			},
+		},
+		{
+			name: "payer data auth with callback secret",
+			modify: func(cfg *Config) {
+				cfg.CallbackSecret = strings.Repeat(
+					"s", minCallbackSecretLen,
+				)
+				cfg.PayerData = &PayerDataSpec{
+					Auth: &PayerDataAuthField{},
+				}
+			},
+		},
+		{
+			name: "missing avatar",
+			modify: func(cfg *Config) {
+				cfg.Avatar = filepath.Join(dir, "avatar.png")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validConfig()
+			test.modify(cfg)
+			require.Error(t, cfg.Validate())
+		})
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	network, addr, err := parseListenAddr("127.0.0.1:8080")
+	require.NoError(t, err)
+	require.Equal(t, "tcp", network)
+	require.Equal(t, "127.0.0.1:8080", addr)
+
+	network, addr, err = parseListenAddr("unix:///run/lndurl.sock")
+	require.NoError(t, err)
+	require.Equal(t, "unix", network)
+	require.Equal(t, "/run/lndurl.sock", addr)
+
+	_, _, err = parseListenAddr("8080")
+	require.Error(t, err)
+}
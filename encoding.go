@@ -1,14 +1,20 @@
 package lndurl
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/ellemouton/lndurl/bech32"
 )
 
 const humanReadablePart = "lnurl"
 
+// ErrNetworkMismatch is returned if an invoice is for another network than
+// the one that it is checked for.
+var ErrNetworkMismatch = errors.New("invoice network mismatch")
+
 func DecodeURL(lnurl string) (string, error) {
 	hrp, data, err := bech32.Decode(lnurl)
 	if err != nil {
@@ -41,3 +47,37 @@ func EncodeURL(url string) (string, error) {
 
 	return strings.ToUpper(str), nil
 }
+
+// CheckInvoiceNetwork checks that the human readable part of the payment
+// request is for the given network. Unlike zpay32, it doesn't accept a
+// regtest invoice (lnbcrt) for mainnet (lnbc). ErrNetworkMismatch is returned
+// if the invoice is for another network.
+func CheckInvoiceNetwork(pr string, chainParams *chaincfg.Params) error {
+	pr = strings.ToLower(pr)
+
+	sep := strings.LastIndex(pr, "1")
+	if sep < 2 || !strings.HasPrefix(pr, "ln") {
+		return fmt.Errorf("no human readable part")
+	}
+	hrp := pr[2:sep]
+
+	// Signet invoices use an extra "s" to tell them apart from testnet
+	// invoices.
+	expected := chainParams.Bech32HRPSegwit
+	if chainParams.Name == chaincfg.SigNetParams.Name {
+		expected = "tbs"
+	}
+
+	// The network prefix may only be followed by the amount.
+	prefix := hrp
+	if i := strings.IndexAny(hrp, "0123456789"); i != -1 {
+		prefix = hrp[:i]
+	}
+	if prefix != expected {
+		return fmt.Errorf("%w: expected an ln%s invoice for %s, got "+
+			"ln%s", ErrNetworkMismatch, expected, chainParams.Name,
+			prefix)
+	}
+
+	return nil
+}
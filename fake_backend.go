@@ -0,0 +1,329 @@
+package lndurl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+// FakeBackend is an in-memory Backend for tests. The invoices that it creates
+// are valid, signed payment requests, but they are only paid once Settle is
+// called. Payments made through it always succeed unless SetPayResult is used
+// to make them fail.
+type FakeBackend struct {
+	params *chaincfg.Params
+	key    *btcec.PrivateKey
+
+	invoices map[lntypes.Hash]*fakeInvoice
+
+	// updates holds every change to the state of an invoice in the
+	// order that they happened in. changed is closed and replaced every
+	// time an update is added.
+	updates []InvoiceUpdate
+	changed chan struct{}
+
+	payments []string
+	payFee   int64
+	payErr   error
+	holdPay  bool
+	closed   bool
+	mu       sync.Mutex
+}
+
+// fakeInvoice is an invoice held by the FakeBackend.
+type fakeInvoice struct {
+	req    *InvoiceRequest
+	update InvoiceUpdate
+}
+
+// A compile time check to ensure that FakeBackend implements Backend.
+var _ Backend = (*FakeBackend)(nil)
+
+// NewFakeBackend creates a fake backend that creates invoices for the given
+// network.
+func NewFakeBackend(params *chaincfg.Params) (*FakeBackend, error) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	return &FakeBackend{
+		params:   params,
+		key:      key,
+		invoices: make(map[lntypes.Hash]*fakeInvoice),
+		changed:  make(chan struct{}),
+	}, nil
+}
+
+// AddInvoice creates a payment request signed by the backend's node key.
+func (b *FakeBackend) AddInvoice(_ context.Context, req *InvoiceRequest) (
+	lntypes.Hash, string, error) {
+
+	if req.Description != "" &&
+		sha256.Sum256([]byte(req.Description)) != req.DescriptionHash {
+
+		return lntypes.Hash{}, "", errors.New("description does not " +
+			"match description hash")
+	}
+
+	hash := req.Preimage.Hash()
+	inv, err := zpay32.NewInvoice(
+		b.params, hash, time.Now(),
+		zpay32.Amount(lnwire.MilliSatoshi(req.AmountMsat)),
+		zpay32.DescriptionHash(req.DescriptionHash),
+		zpay32.Expiry(req.Expiry),
+	)
+	if err != nil {
+		return lntypes.Hash{}, "", err
+	}
+
+	pr, err := inv.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return btcec.SignCompact(
+				btcec.S256(), b.key, chainhash.HashB(msg),
+				true,
+			)
+		},
+	})
+	if err != nil {
+		return lntypes.Hash{}, "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.invoices[hash]; ok {
+		return lntypes.Hash{}, "", fmt.Errorf("invoice %v already "+
+			"exists", hash)
+	}
+
+	reqCopy := *req
+	b.invoices[hash] = &fakeInvoice{
+		req: &reqCopy,
+		update: InvoiceUpdate{
+			Hash:  hash,
+			State: InvoiceStateIssued,
+		},
+	}
+
+	return hash, pr, nil
+}
+
+// SubscribeInvoices sends every change to the state of the backend's invoices
+// from now on until the context is cancelled.
+func (b *FakeBackend) SubscribeInvoices(ctx context.Context) (
+	<-chan InvoiceUpdate, <-chan error, error) {
+
+	b.mu.Lock()
+	next := len(b.updates)
+	b.mu.Unlock()
+
+	updates := make(chan InvoiceUpdate)
+	go func() {
+		defer close(updates)
+
+		for {
+			b.mu.Lock()
+			pending := b.updates[next:]
+			changed := b.changed
+			b.mu.Unlock()
+
+			for _, update := range pending {
+				select {
+				case updates <- update:
+				case <-ctx.Done():
+					return
+				}
+			}
+			next += len(pending)
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates, make(chan error), nil
+}
+
+// LookupInvoice returns the current state of the given invoice.
+func (b *FakeBackend) LookupInvoice(_ context.Context,
+	hash lntypes.Hash) (*InvoiceUpdate, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	inv, ok := b.invoices[hash]
+	if !ok {
+		return nil, fmt.Errorf("unknown invoice %v", hash)
+	}
+
+	update := inv.update
+
+	return &update, nil
+}
+
+// PayInvoice records the payment request as paid.
+func (b *FakeBackend) PayInvoice(ctx context.Context, pr string,
+	maxFeeMsat int64) (*PaymentResult, error) {
+
+	b.mu.Lock()
+	hold := b.holdPay
+	b.mu.Unlock()
+
+	if hold {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.payErr != nil {
+		return nil, b.payErr
+	}
+
+	if b.payFee > maxFeeMsat {
+		return nil, &PaymentFailedError{Err: fmt.Errorf("fee of %d "+
+			"msat exceeds max fee of %d msat", b.payFee,
+			maxFeeMsat)}
+	}
+
+	b.payments = append(b.payments, pr)
+
+	return &PaymentResult{FeeMsat: b.payFee}, nil
+}
+
+// NodeInfo returns the fake node's info.
+func (b *FakeBackend) NodeInfo(context.Context) (*NodeInfo, error) {
+	// chaincfg calls testnet "testnet3", the other networks are named
+	// like lnd and Core Lightning name them.
+	network := b.params.Name
+	if network == chaincfg.TestNet3Params.Name {
+		network = string(lndclient.NetworkTestnet)
+	}
+
+	return &NodeInfo{
+		Alias: "fake",
+		PubKey: hex.EncodeToString(
+			b.key.PubKey().SerializeCompressed(),
+		),
+		Network: network,
+	}, nil
+}
+
+// Close marks the backend as closed.
+func (b *FakeBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+
+	return nil
+}
+
+// Closed returns true if the backend was closed.
+func (b *FakeBackend) Closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.closed
+}
+
+// Invoice returns the request that the invoice with the given hash was
+// created from.
+func (b *FakeBackend) Invoice(hash lntypes.Hash) (*InvoiceRequest, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	inv, ok := b.invoices[hash]
+	if !ok {
+		return nil, false
+	}
+
+	return inv.req, true
+}
+
+// Settle marks the invoice as paid. If amtMsat is zero, the invoice amount is
+// used.
+func (b *FakeBackend) Settle(hash lntypes.Hash, amtMsat int64) error {
+	return b.setState(hash, InvoiceUpdate{
+		State:          InvoiceStateSettled,
+		AmountPaidMsat: amtMsat,
+	})
+}
+
+// Cancel marks the invoice as cancelled.
+func (b *FakeBackend) Cancel(hash lntypes.Hash) error {
+	return b.setState(hash, InvoiceUpdate{State: InvoiceStateCancelled})
+}
+
+// setState moves an open invoice to the given state and notifies its
+// subscribers.
+func (b *FakeBackend) setState(hash lntypes.Hash, update InvoiceUpdate) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	inv, ok := b.invoices[hash]
+	if !ok {
+		return fmt.Errorf("unknown invoice %v", hash)
+	}
+
+	if inv.update.State != InvoiceStateIssued {
+		return fmt.Errorf("invoice %v is no longer open", hash)
+	}
+
+	if update.State == InvoiceStateSettled && update.AmountPaidMsat == 0 {
+		update.AmountPaidMsat = inv.req.AmountMsat
+	}
+	update.Hash = hash
+
+	inv.update = update
+	b.updates = append(b.updates, update)
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	return nil
+}
+
+// Payments returns the payment requests that were paid.
+func (b *FakeBackend) Payments() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]string(nil), b.payments...)
+}
+
+// SetPayResult sets the fee charged for payments or, if err is not nil, makes
+// all payments fail with it. A PaymentFailedError makes them fail definitely,
+// any other error leaves their outcome unknown.
+func (b *FakeBackend) SetPayResult(feeMsat int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.payFee = feeMsat
+	b.payErr = err
+}
+
+// HoldPayments makes payments block until their context is cancelled, as if
+// they never completed.
+func (b *FakeBackend) HoldPayments(hold bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.holdPay = hold
+}
@@ -0,0 +1,141 @@
+package lndurl
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+// LedgerEntry is a single change to a user's balance.
+type LedgerEntry struct {
+	// Username is the user whose balance changed.
+	Username string `json:"username"`
+
+	// AmountMsat is the change in balance. It is positive for credits.
+	AmountMsat int64 `json:"amountMsat"`
+
+	// Hash is the payment hash of the invoice that the entry relates to.
+	Hash lntypes.Hash `json:"hash"`
+
+	// Description describes the entry, for example the payer's comment.
+	Description string `json:"description,omitempty"`
+
+	// Timestamp is the time at which the entry was recorded.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Statement is an overview of a user's ledger over a period of time.
+type Statement struct {
+	// Username is the user that the statement belongs to.
+	Username string
+
+	// OpeningBalanceMsat is the user's balance at the start of the
+	// period.
+	OpeningBalanceMsat int64
+
+	// ClosingBalanceMsat is the user's balance at the end of the period.
+	ClosingBalanceMsat int64
+
+	// Entries are the ledger entries recorded during the period.
+	Entries []*LedgerEntry
+}
+
+// Ledger keeps track of the funds owned by each user when several users
+// receive payments through the same node. All amounts are in millisatoshis.
+type Ledger struct {
+	store Store
+}
+
+// NewLedger creates a ledger backed by the given store.
+func NewLedger(store Store) *Ledger {
+	return &Ledger{store: store}
+}
+
+// Credit adds amt to the user's balance for the invoice with the given hash.
+// Crediting the same invoice more than once has no effect, so it is safe to
+// replay settlements.
+func (l *Ledger) Credit(username string, amt int64, hash lntypes.Hash,
+	description string, at time.Time) error {
+
+	err := l.store.AddLedgerEntry(&LedgerEntry{
+		Username:    username,
+		AmountMsat:  amt,
+		Hash:        hash,
+		Description: description,
+		Timestamp:   at,
+	})
+	if errors.Is(err, ErrDuplicateLedgerEntry) {
+		return nil
+	}
+
+	return err
+}
+
+// HandleInvoiceEvent credits the user that a settled invoice was issued for.
+// It is an InvoiceHandler.
+func (l *Ledger) HandleInvoiceEvent(event *InvoiceEvent) error {
+	inv := event.Invoice
+	if inv.State != InvoiceStateSettled || inv.Username == "" {
+		return nil
+	}
+
+	return l.Credit(
+		inv.Username, event.AmountPaidMsat, inv.Hash, inv.Comment,
+		inv.SettledAt,
+	)
+}
+
+// Balance returns the current balance of the user.
+func (l *Ledger) Balance(username string) (int64, error) {
+	entries, err := l.store.LedgerEntries(username)
+	if err != nil {
+		return 0, err
+	}
+
+	var balance int64
+	for _, entry := range entries {
+		balance += entry.AmountMsat
+	}
+
+	return balance, nil
+}
+
+// Statement returns the user's statement for the period [from, to). A zero
+// from or to leaves the period open on that side.
+func (l *Ledger) Statement(username string, from, to time.Time) (*Statement,
+	error) {
+
+	entries, err := l.store.LedgerEntries(username)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &Statement{
+		Username: username,
+	}
+	for _, entry := range entries {
+		switch {
+		case !from.IsZero() && entry.Timestamp.Before(from):
+			statement.OpeningBalanceMsat += entry.AmountMsat
+
+		case !to.IsZero() && !entry.Timestamp.Before(to):
+			continue
+
+		default:
+			statement.Entries = append(statement.Entries, entry)
+		}
+	}
+
+	statement.ClosingBalanceMsat = statement.OpeningBalanceMsat
+	for _, entry := range statement.Entries {
+		statement.ClosingBalanceMsat += entry.AmountMsat
+	}
+
+	return statement, nil
+}
+
+// Ledger returns the server's ledger.
+func (s *Server) Ledger() *Ledger {
+	return s.ledger
+}
@@ -0,0 +1,72 @@
+package lndurl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// testLedger tests crediting users and building statements on top of the
+// given store.
+func testLedger(t *testing.T, store Store) {
+	defer store.Close()
+
+	ledger := NewLedger(store)
+
+	balance, err := ledger.Balance("alice")
+	require.NoError(t, err)
+	require.Zero(t, balance)
+
+	credits := []struct {
+		username string
+		amt      int64
+		hash     lntypes.Hash
+		at       int64
+	}{
+		{username: "alice", amt: 1000, hash: lntypes.Hash{1}, at: 300},
+		{username: "alice", amt: 2000, hash: lntypes.Hash{2}, at: 100},
+		{username: "bob", amt: 5000, hash: lntypes.Hash{3}, at: 200},
+		{username: "alice", amt: 4000, hash: lntypes.Hash{4}, at: 200},
+	}
+	for _, c := range credits {
+		require.NoError(t, ledger.Credit(
+			c.username, c.amt, c.hash, "", time.Unix(c.at, 0),
+		))
+	}
+
+	// Crediting the same invoice again must not change the balance.
+	require.NoError(t, ledger.Credit(
+		"alice", 1000, lntypes.Hash{1}, "", time.Unix(300, 0),
+	))
+
+	balance, err = ledger.Balance("alice")
+	require.NoError(t, err)
+	require.EqualValues(t, 7000, balance)
+
+	balance, err = ledger.Balance("bob")
+	require.NoError(t, err)
+	require.EqualValues(t, 5000, balance)
+
+	// The full statement lists all entries ordered by time.
+	statement, err := ledger.Statement("alice", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Zero(t, statement.OpeningBalanceMsat)
+	require.EqualValues(t, 7000, statement.ClosingBalanceMsat)
+	require.Len(t, statement.Entries, 3)
+	for i, hash := range []lntypes.Hash{{2}, {4}, {1}} {
+		require.Equal(t, hash, statement.Entries[i].Hash)
+	}
+
+	// Entries before the period count towards the opening balance and
+	// entries after it are left out.
+	statement, err = ledger.Statement(
+		"alice", time.Unix(200, 0), time.Unix(300, 0),
+	)
+	require.NoError(t, err)
+	require.EqualValues(t, 2000, statement.OpeningBalanceMsat)
+	require.EqualValues(t, 6000, statement.ClosingBalanceMsat)
+	require.Len(t, statement.Entries, 1)
+	require.Equal(t, lntypes.Hash{4}, statement.Entries[0].Hash)
+}
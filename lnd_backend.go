@@ -0,0 +1,181 @@
+package lndurl
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/channeldb"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// LndBackend is a Backend that talks to LND over gRPC.
+type LndBackend struct {
+	lnd *lndclient.GrpcLndServices
+}
+
+// A compile time check to ensure that LndBackend implements Backend.
+var _ Backend = (*LndBackend)(nil)
+
+// NewLndBackend connects to the LND node configured by LndAddr, Network,
+// MacaroonDir and TLSPath.
+func NewLndBackend(cfg *Config) (*LndBackend, error) {
+	if cfg.LndAddr == "" {
+		return nil, errors.New("lnd address must be set")
+	}
+
+	lnd, err := lndclient.NewLndServices(&lndclient.LndServicesConfig{
+		LndAddress:  cfg.LndAddr,
+		Network:     cfg.Network,
+		MacaroonDir: cfg.MacaroonDir,
+		TLSPath:     cfg.TLSPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &LndBackend{lnd: lnd}, nil
+}
+
+// AddInvoice creates an invoice that commits to the given description hash.
+func (b *LndBackend) AddInvoice(ctx context.Context, req *InvoiceRequest) (
+	lntypes.Hash, string, error) {
+
+	preimage := req.Preimage
+	return b.lnd.Client.AddInvoice(ctx, &invoicesrpc.AddInvoiceData{
+		Memo:            req.Memo,
+		Preimage:        &preimage,
+		Value:           lnwire.MilliSatoshi(req.AmountMsat),
+		DescriptionHash: req.DescriptionHash[:],
+		Expiry:          int64(req.Expiry.Seconds()),
+	})
+}
+
+// SubscribeInvoices sends an update every time an invoice is added to or
+// settled on the LND node.
+func (b *LndBackend) SubscribeInvoices(ctx context.Context) (
+	<-chan InvoiceUpdate, <-chan error, error) {
+
+	lndInvoices, errChan, err := b.lnd.Client.SubscribeInvoices(
+		ctx, lndclient.InvoiceSubscriptionRequest{},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	updates := make(chan InvoiceUpdate)
+	go func() {
+		defer close(updates)
+
+		for {
+			var inv *lndclient.Invoice
+			select {
+			case i, ok := <-lndInvoices:
+				if !ok {
+					return
+				}
+				inv = i
+
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case updates <- lndInvoiceUpdate(inv):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates, errChan, nil
+}
+
+// LookupInvoice returns the current state of the given invoice.
+func (b *LndBackend) LookupInvoice(ctx context.Context,
+	hash lntypes.Hash) (*InvoiceUpdate, error) {
+
+	inv, err := b.lnd.Client.LookupInvoice(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	update := lndInvoiceUpdate(inv)
+
+	return &update, nil
+}
+
+// lndInvoiceUpdate converts the state of an LND invoice to an InvoiceUpdate.
+func lndInvoiceUpdate(inv *lndclient.Invoice) InvoiceUpdate {
+	update := InvoiceUpdate{
+		Hash:  inv.Hash,
+		State: InvoiceStateIssued,
+	}
+
+	switch inv.State {
+	case channeldb.ContractSettled:
+		update.State = InvoiceStateSettled
+		update.AmountPaidMsat = int64(inv.AmountPaid)
+
+	// LND cancels invoices once they expire, so it can't tell the two
+	// apart.
+	case channeldb.ContractCanceled:
+		update.State = InvoiceStateCancelled
+	}
+
+	return update
+}
+
+// PayInvoice pays the given payment request and waits for the result.
+func (b *LndBackend) PayInvoice(ctx context.Context, pr string,
+	maxFeeMsat int64) (*PaymentResult, error) {
+
+	resChan := b.lnd.Client.PayInvoice(
+		ctx, pr, btcutil.Amount(maxFeeMsat/1000), nil,
+	)
+
+	// lndclient doesn't report anything if the context is cancelled, in
+	// which case lnd may still complete the payment.
+	var res lndclient.PaymentResult
+	select {
+	case res = <-resChan:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if res.Err != nil {
+		// lndclient only returns an error once lnd reports the
+		// payment as failed or if the invoice can't be decoded.
+		return nil, &PaymentFailedError{Err: res.Err}
+	}
+
+	return &PaymentResult{
+		Preimage: res.Preimage,
+		FeeMsat:  int64(res.PaidFee) * 1000,
+	}, nil
+}
+
+// NodeInfo returns information about the LND node.
+func (b *LndBackend) NodeInfo(ctx context.Context) (*NodeInfo, error) {
+	info, err := b.lnd.Client.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NodeInfo{
+		Alias:       info.Alias,
+		PubKey:      hex.EncodeToString(info.IdentityPubkey[:]),
+		Network:     info.Network,
+		BlockHeight: info.BlockHeight,
+	}, nil
+}
+
+// Close closes the connection to LND.
+func (b *LndBackend) Close() error {
+	b.lnd.Close()
+	return nil
+}
@@ -0,0 +1,237 @@
+package lndurl
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+// MemoryStore is a Store that keeps everything in memory. It is intended for
+// tests and for servers that don't need to survive restarts.
+type MemoryStore struct {
+	metadata map[string]*Metadata
+	invoices map[lntypes.Hash]*Invoice
+	ledger   map[string][]*LedgerEntry
+	withdraw map[string]*WithdrawLink
+	mu       sync.Mutex
+}
+
+// A compile time check to ensure that MemoryStore implements Store.
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates a new, empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		metadata: make(map[string]*Metadata),
+		invoices: make(map[lntypes.Hash]*Invoice),
+		ledger:   make(map[string][]*LedgerEntry),
+		withdraw: make(map[string]*WithdrawLink),
+	}
+}
+
+// AddMetadata stores metadata that was handed out to a payer unless max
+// entries are already outstanding.
+func (m *MemoryStore) AddMetadata(meta *Metadata, max int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, replace := m.metadata[meta.ID]
+	if !replace && max > 0 && len(m.metadata) >= max {
+		return ErrMetadataFull
+	}
+
+	metaCopy := *meta
+	m.metadata[meta.ID] = &metaCopy
+
+	return nil
+}
+
+// FetchMetadata returns the metadata with the given id.
+func (m *MemoryStore) FetchMetadata(id string) (*Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.metadata[id]
+	if !ok {
+		return nil, ErrMetadataNotFound
+	}
+	metaCopy := *meta
+
+	return &metaCopy, nil
+}
+
+// PopMetadata atomically fetches and removes the metadata with the given id.
+func (m *MemoryStore) PopMetadata(id string) (*Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.metadata[id]
+	if !ok {
+		return nil, ErrMetadataNotFound
+	}
+	delete(m.metadata, id)
+
+	return meta, nil
+}
+
+// DeleteExpiredMetadata removes all metadata that was created before the
+// given time.
+func (m *MemoryStore) DeleteExpiredMetadata(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for id, meta := range m.metadata {
+		if meta.CreatedAt.Before(before) {
+			delete(m.metadata, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// NumMetadata returns the number of outstanding metadata entries.
+func (m *MemoryStore) NumMetadata() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.metadata), nil
+}
+
+// AddInvoice stores a newly issued invoice.
+func (m *MemoryStore) AddInvoice(inv *Invoice) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invCopy := *inv
+	m.invoices[inv.Hash] = &invCopy
+
+	return nil
+}
+
+// FetchInvoice returns the invoice with the given payment hash.
+func (m *MemoryStore) FetchInvoice(hash lntypes.Hash) (*Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invoices[hash]
+	if !ok {
+		return nil, ErrInvoiceNotFound
+	}
+	invCopy := *inv
+
+	return &invCopy, nil
+}
+
+// UpdateInvoiceState updates the state of the invoice with the given payment
+// hash.
+func (m *MemoryStore) UpdateInvoiceState(hash lntypes.Hash,
+	state InvoiceState, at time.Time) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invoices[hash]
+	if !ok {
+		return ErrInvoiceNotFound
+	}
+
+	inv.State = state
+	if state == InvoiceStateSettled {
+		inv.SettledAt = at
+	}
+
+	return nil
+}
+
+// ListInvoices returns all stored invoices ordered by creation time.
+func (m *MemoryStore) ListInvoices() ([]*Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invoices := make([]*Invoice, 0, len(m.invoices))
+	for _, inv := range m.invoices {
+		invCopy := *inv
+		invoices = append(invoices, &invCopy)
+	}
+
+	sort.Slice(invoices, func(i, j int) bool {
+		return invoices[i].CreatedAt.Before(invoices[j].CreatedAt)
+	})
+
+	return invoices, nil
+}
+
+// AddLedgerEntry records an entry in a user's ledger.
+func (m *MemoryStore) AddLedgerEntry(entry *LedgerEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.ledger[entry.Username] {
+		if e.Hash == entry.Hash {
+			return ErrDuplicateLedgerEntry
+		}
+	}
+
+	entryCopy := *entry
+	m.ledger[entry.Username] = append(m.ledger[entry.Username], &entryCopy)
+
+	return nil
+}
+
+// LedgerEntries returns all ledger entries of the given user ordered by time.
+func (m *MemoryStore) LedgerEntries(username string) ([]*LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]*LedgerEntry, 0, len(m.ledger[username]))
+	for _, e := range m.ledger[username] {
+		entryCopy := *e
+		entries = append(entries, &entryCopy)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+
+	return entries, nil
+}
+
+// PutWithdrawLink stores the given withdraw link, replacing any link with the
+// same k1.
+func (m *MemoryStore) PutWithdrawLink(link *WithdrawLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	linkCopy := *link
+	m.withdraw[link.K1] = &linkCopy
+
+	return nil
+}
+
+// ListWithdrawLinks returns all stored withdraw links ordered by creation
+// time.
+func (m *MemoryStore) ListWithdrawLinks() ([]*WithdrawLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	links := make([]*WithdrawLink, 0, len(m.withdraw))
+	for _, link := range m.withdraw {
+		linkCopy := *link
+		links = append(links, &linkCopy)
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.Before(links[j].CreatedAt)
+	})
+
+	return links, nil
+}
+
+// Close is a no-op for the MemoryStore.
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package lndurl
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// ParsePayerData parses the raw JSON payerdata parameter sent by LN WALLET and
+// validates it against the payer data that was requested. authK1 is the k1
+// that was handed out along with the request, if auth was requested.
+func ParsePayerData(raw []byte, spec *PayerDataSpec,
+	authK1 string) (*PayerData, error) {
+
+	var data PayerData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("invalid payerdata: %w", err)
+	}
+
+	if err := data.Validate(spec, authK1); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// Validate checks that all mandatory fields of the spec are present, that no
+// fields were provided that were not asked for and that the provided fields
+// are well-formed.
+func (p *PayerData) Validate(spec *PayerDataSpec, authK1 string) error {
+	if spec == nil {
+		return errors.New("payer data was not requested")
+	}
+
+	if err := checkPayerDataField(
+		"name", p.Name != "", spec.Name,
+	); err != nil {
+		return err
+	}
+
+	if err := checkPayerDataField(
+		"pubkey", p.Pubkey != "", spec.Pubkey,
+	); err != nil {
+		return err
+	}
+
+	if err := checkPayerDataField(
+		"identifier", p.Identifier != "", spec.Identifier,
+	); err != nil {
+		return err
+	}
+
+	if err := checkPayerDataField(
+		"email", p.Email != "", spec.Email,
+	); err != nil {
+		return err
+	}
+
+	var authField *PayerDataField
+	if spec.Auth != nil {
+		authField = &PayerDataField{Mandatory: spec.Auth.Mandatory}
+	}
+	if err := checkPayerDataField(
+		"auth", p.Auth != nil, authField,
+	); err != nil {
+		return err
+	}
+
+	if p.Pubkey != "" {
+		key, err := hex.DecodeString(p.Pubkey)
+		if err != nil {
+			return fmt.Errorf("payerdata pubkey is not hex: %w", err)
+		}
+
+		if _, err := btcec.ParsePubKey(key, btcec.S256()); err != nil {
+			return fmt.Errorf("invalid payerdata pubkey: %w", err)
+		}
+	}
+
+	if p.Email != "" {
+		if _, err := mail.ParseAddress(p.Email); err != nil {
+			return fmt.Errorf("invalid payerdata email: %w", err)
+		}
+	}
+
+	if p.Auth != nil {
+		if p.Auth.K1 != authK1 {
+			return errors.New("payerdata auth k1 does not match")
+		}
+
+		_, err := VerifyAuthSignature(p.Auth.K1, p.Auth.Sig, p.Auth.Key)
+		if err != nil {
+			return fmt.Errorf("invalid payerdata auth: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// checkPayerDataField checks a single payer data field against the field
+// that was requested.
+func checkPayerDataField(name string, present bool,
+	field *PayerDataField) error {
+
+	switch {
+	case present && field == nil:
+		return fmt.Errorf("payerdata field '%s' was not requested", name)
+
+	case !present && field != nil && field.Mandatory:
+		return fmt.Errorf("payerdata field '%s' is mandatory", name)
+	}
+
+	return nil
+}
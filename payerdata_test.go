@@ -0,0 +1,134 @@
+package lndurl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePayerData(t *testing.T) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	key := hex.EncodeToString(priv.PubKey().SerializeCompressed())
+
+	var k1Bytes [32]byte
+	_, err = rand.Read(k1Bytes[:])
+	require.NoError(t, err)
+	k1 := hex.EncodeToString(k1Bytes[:])
+
+	sig, err := priv.Sign(k1Bytes[:])
+	require.NoError(t, err)
+
+	spec := &PayerDataSpec{
+		Name:   &PayerDataField{Mandatory: true},
+		Email:  &PayerDataField{},
+		Pubkey: &PayerDataField{},
+		Auth:   &PayerDataAuthField{K1: k1},
+	}
+
+	marshal := func(data *PayerData) []byte {
+		b, err := json.Marshal(data)
+		require.NoError(t, err)
+
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		data    *PayerData
+		wantErr bool
+	}{
+		{
+			name: "all fields",
+			data: &PayerData{
+				Name:   "Satoshi",
+				Email:  "satoshi@gmx.com",
+				Pubkey: key,
+				Auth: &PayerDataAuth{
+					Key: key,
+					K1:  k1,
+					Sig: hex.EncodeToString(sig.Serialize()),
+				},
+			},
+		},
+		{
+			name: "mandatory only",
+			data: &PayerData{Name: "Satoshi"},
+		},
+		{
+			name:    "missing mandatory",
+			data:    &PayerData{Email: "satoshi@gmx.com"},
+			wantErr: true,
+		},
+		{
+			name: "not requested",
+			data: &PayerData{
+				Name:       "Satoshi",
+				Identifier: "satoshi@bitcoin.org",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid email",
+			data: &PayerData{
+				Name:  "Satoshi",
+				Email: "not an email",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid pubkey",
+			data: &PayerData{
+				Name:   "Satoshi",
+				Pubkey: "02abcd",
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong k1",
+			data: &PayerData{
+				Name: "Satoshi",
+				Auth: &PayerDataAuth{
+					Key: key,
+					K1:  hex.EncodeToString(make([]byte, 32)),
+					Sig: hex.EncodeToString(sig.Serialize()),
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid signature",
+			data: &PayerData{
+				Name: "Satoshi",
+				Auth: &PayerDataAuth{
+					Key: hex.EncodeToString(
+						priv.PubKey().SerializeUncompressed(),
+					),
+					K1:  k1,
+					Sig: hex.EncodeToString(sig.Serialize()[1:]),
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParsePayerData(marshal(test.data), spec, k1)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	// Payer data must be rejected if none was requested.
+	_, err = ParsePayerData([]byte(`{"name":"Satoshi"}`), nil, "")
+	require.Error(t, err)
+}
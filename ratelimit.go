@@ -0,0 +1,212 @@
+package lndurl
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// clientLimiterExpiry is how long a client's limiter is kept around
+	// after its last request.
+	clientLimiterExpiry = 10 * time.Minute
+)
+
+// clientLimiter is the token bucket of a single client IP.
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter throttles requests per client IP and limits the rate at which
+// invoices are created across all clients.
+type rateLimiter struct {
+	perIPRate  rate.Limit
+	perIPBurst int
+
+	// invoices is the global invoice creation limiter. It is nil if
+	// global limiting is disabled.
+	invoices *rate.Limiter
+
+	// trustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For header we trust.
+	trustedProxies []*net.IPNet
+
+	clients map[string]*clientLimiter
+	mu      sync.Mutex
+}
+
+// newRateLimiter creates a rateLimiter from the server config.
+func newRateLimiter(cfg *Config) (*rateLimiter, error) {
+	l := &rateLimiter{
+		perIPRate:  rate.Limit(cfg.PerIPRate),
+		perIPBurst: cfg.PerIPBurst,
+		clients:    make(map[string]*clientLimiter),
+	}
+	if l.perIPBurst == 0 {
+		l.perIPBurst = int(math.Ceil(cfg.PerIPRate))
+	}
+
+	if cfg.InvoiceRate > 0 {
+		burst := cfg.InvoiceBurst
+		if burst == 0 {
+			burst = int(math.Ceil(cfg.InvoiceRate))
+		}
+
+		l.invoices = rate.NewLimiter(rate.Limit(cfg.InvoiceRate), burst)
+	}
+
+	for _, proxy := range cfg.TrustedProxies {
+		// Allow single IPs as well as CIDRs.
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy "+
+					"'%s'", proxy)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxy = fmt.Sprintf("%s/%d", proxy, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w",
+				proxy, err)
+		}
+		l.trustedProxies = append(l.trustedProxies, ipNet)
+	}
+
+	return l, nil
+}
+
+// isTrusted returns true if the given IP belongs to a trusted proxy.
+func (l *rateLimiter) isTrusted(ip net.IP) bool {
+	for _, ipNet := range l.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP determines the IP of the client that made the request. The
+// X-Forwarded-For header is only honoured if the request came from a trusted
+// proxy, in which case the right-most address that isn't a trusted proxy is
+// used.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !l.isTrusted(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(
+		strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",",
+	)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// We can't trust anything to the left of a malformed
+			// entry.
+			break
+		}
+
+		host = hop.String()
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+
+	return host
+}
+
+// allowClient reports whether the client with the given IP may make another
+// request.
+func (l *rateLimiter) allowClient(ip string) bool {
+	if l.perIPRate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimiter{
+			limiter: rate.NewLimiter(l.perIPRate, l.perIPBurst),
+		}
+		l.clients[ip] = client
+	}
+	client.lastSeen = time.Now()
+
+	return client.limiter.Allow()
+}
+
+// prune removes the limiters of clients that have not been seen since the
+// given time.
+func (l *rateLimiter) prune(before time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, client := range l.clients {
+		if client.lastSeen.Before(before) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// limit wraps the handler so that requests are throttled per client IP.
+func (l *rateLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.allowClient(l.clientIP(r)) {
+			l.reject(w, l.perIPRate)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// allowInvoice reports whether another invoice may be created under the
+// global invoice creation limit. If not, the client is told to slow down. It
+// must only be called once the request has been validated, right before the
+// invoice is created, so that invalid requests don't use up the limit.
+func (l *rateLimiter) allowInvoice(w http.ResponseWriter) bool {
+	if l.invoices == nil || l.invoices.Allow() {
+		return true
+	}
+
+	l.reject(w, l.invoices.Limit())
+
+	return false
+}
+
+// reject responds with an LNURL error telling the client to slow down.
+func (l *rateLimiter) reject(w http.ResponseWriter, limit rate.Limit) {
+	retryAfter := 1
+	if limit > 0 && limit < 1 {
+		retryAfter = int(math.Ceil(1 / float64(limit)))
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(
+		w, http.StatusTooManyRequests,
+		"rate limit exceeded, please try again later",
+	)
+}
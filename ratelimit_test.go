@@ -0,0 +1,115 @@
+package lndurl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	l, err := newRateLimiter(&Config{
+		TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "1.2.3.4:5000",
+			expected:   "1.2.3.4",
+		},
+		{
+			name:       "untrusted proxy",
+			remoteAddr: "1.2.3.4:5000",
+			forwarded:  "5.6.7.8",
+			expected:   "1.2.3.4",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:5000",
+			forwarded:  "5.6.7.8",
+			expected:   "5.6.7.8",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.0.0.1:5000",
+			forwarded:  "6.6.6.6, 5.6.7.8, 192.168.1.1",
+			expected:   "5.6.7.8",
+		},
+		{
+			name:       "trusted proxy without header",
+			remoteAddr: "10.0.0.1:5000",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "malformed header",
+			remoteAddr: "10.0.0.1:5000",
+			forwarded:  "5.6.7.8, garbage",
+			expected:   "10.0.0.1",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/pay", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+
+			require.Equal(t, test.expected, l.clientIP(r))
+		})
+	}
+
+	_, err = newRateLimiter(&Config{TrustedProxies: []string{"nope"}})
+	require.Error(t, err)
+}
+
+func TestRateLimit(t *testing.T) {
+	l, err := newRateLimiter(&Config{
+		PerIPRate:    0.001,
+		PerIPBurst:   2,
+		InvoiceRate:  0.001,
+		InvoiceBurst: 3,
+	})
+	require.NoError(t, err)
+
+	invoice := l.limit(func(w http.ResponseWriter, r *http.Request) {
+		l.allowInvoice(w)
+	})
+
+	request := func(ip string) int {
+		r := httptest.NewRequest(http.MethodGet, "/invoice", nil)
+		r.RemoteAddr = ip + ":1234"
+
+		w := httptest.NewRecorder()
+		invoice(w, r)
+
+		return w.Code
+	}
+
+	// Each client gets its own burst.
+	require.Equal(t, http.StatusOK, request("1.1.1.1"))
+	require.Equal(t, http.StatusOK, request("1.1.1.1"))
+	require.Equal(t, http.StatusTooManyRequests, request("1.1.1.1"))
+
+	// But all clients share the global invoice limit.
+	require.Equal(t, http.StatusOK, request("2.2.2.2"))
+	require.Equal(t, http.StatusTooManyRequests, request("2.2.2.2"))
+
+	// Over-limit responses are LNURL errors.
+	r := httptest.NewRequest(http.MethodGet, "/invoice", nil)
+	r.RemoteAddr = "1.1.1.1:1234"
+	w := httptest.NewRecorder()
+	invoice(w, r)
+	require.Contains(t, w.Body.String(), `"status":"ERROR"`)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+}
@@ -2,92 +2,480 @@ package lndurl
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html"
-	"math/rand"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
-	"github.com/lightninglabs/lndclient"
-	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
-	"github.com/lightningnetwork/lnd/lnwire"
 )
 
 type Server struct {
-	cfg       *Config
-	lndClient lndclient.LightningClient
+	cfg     *Config
+	backend Backend
 
-	paymentMetadata map[string]*metadata
-	metadataMu      sync.Mutex
-}
+	store    Store
+	users    UserRegistry
+	ledger   *Ledger
+	tracker  *InvoiceTracker
+	webhooks *webhookNotifier
 
-type metadata struct {
-	data      string
-	createdAt time.Time
-}
+	withdrawLinks   map[string]*WithdrawLink
+	defaultWithdraw string
+
+	// withdrawPayments holds the payment hashes of the withdraw invoices
+	// that are being paid or have been paid.
+	withdrawPayments map[lntypes.Hash]struct{}
+	withdrawMu       sync.Mutex
+
+	auth *authSessions
+
+	limiter *rateLimiter
+
+	// avatar is the image of the static pay code, which is also shown
+	// for users without their own avatar. It is nil if none is
+	// configured.
+	avatar *MetadataEntry
+
+	// certs holds the TLS certificate if the server serves HTTPS.
+	certs *certReloader
+
+	mux        *http.ServeMux
+	httpServer *http.Server
+
+	// serveErr receives the error that the HTTP server failed with, if
+	// any.
+	serveErr chan error
+
+	stopOnce sync.Once
+	stopErr  error
 
-type Config struct {
-	Protocol        string
-	Username        string
-	Host            string
-	Port            int
-	LndAddr         string
-	Network         lndclient.Network
-	MacaroonDir     string
-	TLSPath         string
-	MinMsatSendable int64
-	MaxMsatSendable int64
+	quit chan struct{}
+	wg   sync.WaitGroup
 }
 
-func NewServer(cfg *Config) (*Server, error) {
+// errTooManyPending is returned if no more pay requests can be handed out
+// until pending ones have been used or have expired.
+var errTooManyPending = errors.New("too many pending pay requests, try " +
+	"again later")
+
+const (
+	// DefaultMetadataExpiry is the default value of
+	// Config.MetadataExpiry.
+	DefaultMetadataExpiry = 10 * time.Minute
+
+	// DefaultMaxPendingMetadata is the default value of
+	// Config.MaxPendingMetadata.
+	DefaultMaxPendingMetadata = 10000
+
+	// maxReapInterval is the max time between two runs of the metadata
+	// reaper.
+	maxReapInterval = time.Minute
+
+	// lnAddressPath is the path under which Lightning Addresses are
+	// served.
+	lnAddressPath = "/.well-known/lnurlp/"
+
+	// invoiceExpiry is how long the invoices handed out by the server
+	// can be paid for.
+	invoiceExpiry = time.Hour
+
+	// shutdownTimeout is how long we wait for in-flight requests to
+	// complete when the server is stopped.
+	shutdownTimeout = 10 * time.Second
+)
+
+// NewServer creates a server that creates invoices on the given backend. The
+// server takes ownership of the backend and closes it when it is stopped.
+func NewServer(cfg *Config, backend Backend) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	if backend == nil {
+		return nil, errors.New("a lightning backend must be set")
+	}
+
 	s := Server{
-		cfg:             cfg,
-		paymentMetadata: make(map[string]*metadata),
+		cfg:              cfg,
+		backend:          backend,
+		withdrawLinks:    make(map[string]*WithdrawLink),
+		withdrawPayments: make(map[lntypes.Hash]struct{}),
+		auth:             newAuthSessions(),
+		serveErr:         make(chan error, 1),
+		quit:             make(chan struct{}),
 	}
 
-	// Connect to LND.
-	lnd, err := lndclient.NewLndServices(&lndclient.LndServicesConfig{
-		LndAddress:  cfg.LndAddr,
-		Network:     cfg.Network,
-		MacaroonDir: cfg.MacaroonDir,
-		TLSPath:     cfg.TLSPath,
-	})
+	if cfg.MetadataExpiry == 0 {
+		cfg.MetadataExpiry = DefaultMetadataExpiry
+	}
+	if cfg.MaxPendingMetadata == 0 {
+		cfg.MaxPendingMetadata = DefaultMaxPendingMetadata
+	}
+
+	// Make sure that the configured success action is valid before we
+	// start handing it out.
+	if _, err := s.successAction(lntypes.Preimage{}); err != nil {
+		return nil, fmt.Errorf("invalid success action: %w", err)
+	}
+
+	if cfg.Avatar != "" {
+		avatar, err := loadAvatar(cfg.Avatar)
+		if err != nil {
+			return nil, err
+		}
+		s.avatar = avatar
+	}
+
+	s.store = NewMemoryStore()
+	if cfg.DBPath != "" {
+		store, err := NewBoltStore(cfg.DBPath)
+		if err != nil {
+			return nil, err
+		}
+		s.store = store
+	}
+	s.ledger = NewLedger(s.store)
+
+	s.users = cfg.Users
+	if s.users == nil {
+		users, err := newUserRegistry(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.users = users
+	}
+
+	spoolDir := cfg.WebhookSpoolDir
+	if spoolDir == "" && cfg.DBPath != "" {
+		spoolDir = filepath.Join(filepath.Dir(cfg.DBPath), "webhooks")
+	}
+	webhooks, err := newWebhookNotifier(cfg.Webhooks, spoolDir)
 	if err != nil {
 		return nil, err
 	}
-	s.lndClient = lnd.Client
+	s.webhooks = webhooks
 
-	// Register routes with the http default mux.
-	http.HandleFunc("/pay", s.pay(false))
-	http.HandleFunc("/invoice", s.invoice)
-	http.HandleFunc(
-		fmt.Sprintf("/.well-known/lnurlp/%s", cfg.Username),
-		s.pay(true),
-	)
+	s.limiter, err = newRateLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	limit := s.limiter.limit
+
+	if cfg.TLSSelfSigned {
+		err := ensureSelfSignedCert(
+			cfg.TLSCertPath, cfg.TLSKeyPath, cfg.Host,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TLSCertPath != "" {
+		s.certs, err = newCertReloader(cfg.TLSCertPath, cfg.TLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Track the invoices we hand out and credit their users once they
+	// are settled.
+	s.tracker = NewInvoiceTracker(s.store, backend)
+	s.tracker.AddHandler(s.ledger.HandleInvoiceEvent)
+	s.tracker.AddHandler(s.notifyWebhooks)
+
+	// Register routes with our own mux so that the server can be embedded
+	// next to other handlers.
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/pay", limit(s.pay))
+	s.mux.HandleFunc("/invoice", limit(s.invoice))
+	s.mux.HandleFunc("/withdraw", limit(s.withdraw))
+	s.mux.HandleFunc("/withdraw/callback", limit(s.withdrawCallback))
+	s.mux.HandleFunc("/auth", limit(s.authCallback))
+	s.mux.HandleFunc("/auth/challenge", limit(s.authChallenge))
+	s.mux.HandleFunc("/auth/status", limit(s.authStatus))
+	s.mux.HandleFunc(lnAddressPath, limit(s.lnAddress))
+
+	// Restore the withdraw links with their remaining budgets.
+	links, err := s.store.ListWithdrawLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultLink *WithdrawLink
+	for _, link := range links {
+		s.withdrawLinks[link.K1] = link
+		if link.Default {
+			defaultLink = link
+		}
+	}
+
+	if cfg.WithdrawBudget > 0 {
+		if defaultLink == nil {
+			defaultLink, err = s.newWithdrawLink(
+				cfg.WithdrawBudget,
+				fmt.Sprintf("Withdrawal from %s", cfg.Host),
+				true,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("could not create "+
+					"default withdraw link: %w", err)
+			}
+		}
+
+		s.defaultWithdraw, err = s.withdrawLinkURL(defaultLink)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &s, nil
 }
 
-func (s *Server) Run() error {
+// Start checks the connection to the node, starts the background goroutines
+// and starts serving requests in the background. The context only bounds the
+// calls made while starting up. Stop must be called to release the server's
+// resources, even if Start fails.
+func (s *Server) Start(ctx context.Context) error {
 	if err := s.printHello(); err != nil {
 		return err
 	}
 
-	info, err := s.lndClient.GetInfo(context.Background())
+	info, err := s.backend.NodeInfo(ctx)
 	if err != nil {
 		return err
 	}
 
 	fmt.Println("Connected to node with alias:", info.Alias)
 
-	return http.ListenAndServe(":8080", nil)
+	if info.Network != string(s.cfg.Network) {
+		return fmt.Errorf("node runs on %s, but %s is configured",
+			info.Network, s.cfg.Network)
+	}
+
+	if err := s.webhooks.Start(); err != nil {
+		return err
+	}
+
+	if err := s.tracker.Start(); err != nil {
+		return err
+	}
+
+	s.wg.Add(3)
+	go s.reapMetadata()
+	go s.reapAuthSessions()
+	go s.pruneRateLimits()
+
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	if s.certs != nil {
+		listener = tls.NewListener(listener, s.certs.tlsConfig())
+
+		s.wg.Add(1)
+		go s.watchCert()
+	}
+
+	s.httpServer = &http.Server{Handler: s.mux}
+	go func() {
+		err := s.httpServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.serveErr <- err
+		}
+	}()
+
+	return nil
+}
+
+// Run starts the server and blocks until the context is cancelled or the
+// HTTP server fails. The server is stopped before Run returns.
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Start(ctx); err != nil {
+		if stopErr := s.Stop(); stopErr != nil {
+			log.Printf("Could not stop server: %v", stopErr)
+		}
+
+		return err
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-s.serveErr:
+	}
+
+	if stopErr := s.Stop(); err == nil {
+		err = stopErr
+	}
+
+	return err
+}
+
+// Handler returns the handler serving all of the server's routes. It can be
+// used to mount the server in an existing HTTP server instead of calling Run.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// listen opens the listener for the configured listen address. If no listen
+// address is configured, we listen on the public port on all interfaces. A
+// stale unix socket left behind by a previous run is removed.
+func (s *Server) listen() (net.Listener, error) {
+	network, addr := "tcp", fmt.Sprintf(":%d", s.cfg.Port)
+	if s.cfg.ListenAddr != "" {
+		var err error
+		network, addr, err = parseListenAddr(s.cfg.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if network == "unix" {
+		info, err := os.Stat(addr)
+		if err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Listening on %s", listener.Addr())
+
+	return listener, nil
+}
+
+// Stop gracefully shuts down the HTTP server, waiting up to shutdownTimeout
+// for in-flight requests, then stops all background goroutines and closes the
+// LND connection and the store. It is safe to call Stop more than once.
+func (s *Server) Stop() error {
+	s.stopOnce.Do(func() {
+		s.stopErr = s.stop()
+	})
+
+	return s.stopErr
+}
+
+// stop releases the server's resources. It must only be called once.
+func (s *Server) stop() error {
+	if s.httpServer != nil {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), shutdownTimeout,
+		)
+		defer cancel()
+
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			log.Printf("Could not drain HTTP server: %v", err)
+			s.httpServer.Close()
+		}
+	}
+
+	close(s.quit)
+	s.wg.Wait()
+	s.tracker.Stop()
+	s.webhooks.Stop()
+
+	if err := s.backend.Close(); err != nil {
+		log.Printf("Could not close backend: %v", err)
+	}
+
+	return s.store.Close()
+}
+
+// pruneRateLimits periodically forgets about clients that haven't made any
+// requests in a while. It must be run as a goroutine.
+func (s *Server) pruneRateLimits() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(clientLimiterExpiry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.limiter.prune(time.Now().Add(-clientLimiterExpiry))
+
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// reapMetadata periodically removes expired metadata from the store. It must
+// be run as a goroutine.
+func (s *Server) reapMetadata() {
+	defer s.wg.Done()
+
+	interval := s.cfg.MetadataExpiry
+	if interval > maxReapInterval {
+		interval = maxReapInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.store.DeleteExpiredMetadata(
+				time.Now().Add(-s.cfg.MetadataExpiry),
+			)
+			if err != nil {
+				log.Printf("Could not delete expired metadata: "+
+					"%v", err)
+				continue
+			}
+
+			if n > 0 {
+				log.Printf("Deleted %d expired metadata entries", n)
+			}
+
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// reapAuthSessions periodically removes auth sessions whose challenge has
+// expired without being answered and authenticated sessions that have
+// expired. It must be run as a goroutine.
+func (s *Server) reapAuthSessions() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(maxReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n := s.auth.reap(time.Now())
+			if n > 0 {
+				log.Printf("Deleted %d expired auth "+
+					"sessions", n)
+			}
+
+		case <-s.quit:
+			return
+		}
+	}
 }
 
 func (s *Server) printHello() error {
@@ -100,11 +488,6 @@ func (s *Server) printHello() error {
 		return err
 	}
 
-	lnAddress := fmt.Sprintf("%s@%s", s.cfg.Username, s.cfg.Host)
-	if s.cfg.Port != 80 {
-		lnAddress += fmt.Sprintf(":%d", s.cfg.Port)
-	}
-
 	fmt.Printf(
 		""+
 			"=======================================\n"+
@@ -112,127 +495,498 @@ func (s *Server) printHello() error {
 			"Your static LNURL-pay code is: \n"+
 			"- %s\n"+
 			"- lightning:%s\n"+
-			"- %s\n"+
-			"- %s\n"+
-			"=======================================\n",
+			"- %s\n",
 		payLNURL, payLNURL, strings.Replace(
 			payCode, s.cfg.Protocol, "lnurlp", 1,
-		), lnAddress,
+		),
 	)
 
+	users, err := s.users.Users()
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 {
+		fmt.Println("Your Lightning Addresses are:")
+	}
+	for _, user := range users {
+		fmt.Printf("- %s\n", s.lnAddressFor(user.Username))
+	}
+	fmt.Println("=======================================")
+
+	if s.defaultWithdraw != "" {
+		fmt.Printf(""+
+			"Your LNURL-withdraw code (budget: %d msat) is: \n"+
+			"- %s\n"+
+			"=======================================\n",
+			s.cfg.WithdrawBudget, s.defaultWithdraw,
+		)
+	}
+
 	return nil
 }
 
-func (s *Server) pay(lnAddress bool) func(w http.ResponseWriter,
-	r *http.Request) {
+// pay handles requests to the server's static LNURL-pay code.
+func (s *Server) pay(w http.ResponseWriter, r *http.Request) {
+	s.payRequest(w, nil)
+}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		// TODO(elle): checkout client IP here to throttle requests.
+// lnAddress handles requests to /.well-known/lnurlp/<username> for any of the
+// users in the registry.
+func (s *Server) lnAddress(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimPrefix(r.URL.Path, lnAddressPath)
 
-		var hash [32]byte
-		if _, err := rand.Read(hash[:]); err != nil {
-			http.Error(
-				w, err.Error(), http.StatusInternalServerError,
-			)
-			return
-		}
+	user, err := s.users.LookupUser(username)
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(
+			w, http.StatusNotFound,
+			fmt.Sprintf("unknown user '%s'", username),
+		)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		h := hex.EncodeToString(hash[:])
-		id := hex.EncodeToString(hash[:10])
-		meta := &metadata{
-			data:      fmt.Sprintf("[[\"text/plain\",\"%s\"]]", h),
-			createdAt: time.Now(),
-		}
+	s.payRequest(w, user)
+}
 
-		if lnAddress {
-			addr := fmt.Sprintf("%s@%s", s.cfg.Username, s.cfg.Host)
-			if s.cfg.Port != 80 {
-				addr += fmt.Sprintf(":%d", s.cfg.Port)
+// payRequest responds with the payRequest parameters. If user is nil, the
+// server's defaults are used.
+func (s *Server) payRequest(w http.ResponseWriter, user *User) {
+	var (
+		meta *Metadata
+		data string
+		err  error
+	)
+	if s.stateless() {
+		meta, data, err = s.signedMetadata(user)
+	} else {
+		meta, data, err = s.storedMetadata(user)
+	}
+	switch {
+	case errors.Is(err, errTooManyPending):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// If payer data is requested, copy the spec so that we can add the
+	// auth challenge of this pay request if required.
+	var payerData *PayerDataSpec
+	if s.cfg.PayerData != nil {
+		spec := *s.cfg.PayerData
+		if spec.Auth != nil {
+			spec.Auth = &PayerDataAuthField{
+				Mandatory: spec.Auth.Mandatory,
+				K1:        meta.AuthK1,
 			}
+		}
+		payerData = &spec
+	}
 
-			meta.data = fmt.Sprintf("[[\"text/plain\",\"%s\"],[\"text/identifier\",\"%s\"]]", h, addr)
+	getInvoice := fmt.Sprintf(
+		"%s://%s:%d/invoice?id=%s", s.cfg.Protocol, s.cfg.Host,
+		s.cfg.Port, meta.ID,
+	)
+
+	minSendable, maxSendable := s.sendable(user)
+	resp := &PayResponse{
+		Callback:       getInvoice,
+		MinSendable:    minSendable,
+		MaxSendable:    maxSendable,
+		Metadata:       data,
+		CommentAllowed: s.cfg.CommentAllowed,
+		PayerData:      payerData,
+		Tag:            TypePayRequest,
+	}
+
+	writeJSON(w, resp)
+}
+
+// storedMetadata creates random metadata for a pay request to the given user
+// and adds it to the store so that its callback can be called once. It returns
+// the metadata along with the raw metadata string.
+func (s *Server) storedMetadata(user *User) (*Metadata, string, error) {
+	var hash [32]byte
+	if _, err := rand.Read(hash[:]); err != nil {
+		return nil, "", err
+	}
+
+	meta := &Metadata{
+		ID:        hex.EncodeToString(hash[:10]),
+		Fallback:  hex.EncodeToString(hash[:]),
+		CreatedAt: time.Now(),
+	}
+
+	if user != nil {
+		meta.Username = user.Username
+	}
+
+	data, err := s.userMetadata(user, meta.Fallback)
+	if err != nil {
+		return nil, "", err
+	}
+	meta.Hash = sha256.Sum256([]byte(data))
+
+	if s.cfg.PayerData != nil && s.cfg.PayerData.Auth != nil {
+		var k1 [32]byte
+		if _, err := rand.Read(k1[:]); err != nil {
+			return nil, "", err
 		}
+		meta.AuthK1 = hex.EncodeToString(k1[:])
+	}
 
-		// TODO(elle): kick off a goroutine to expire & delete this
-		//  metadata after x amount of time.
-		s.metadataMu.Lock()
-		s.paymentMetadata[id] = meta
-		s.metadataMu.Unlock()
+	// The metadata is removed by the reaper if the callback is not called
+	// before it expires. We refuse to hand out any more metadata if there
+	// are already too many outstanding requests.
+	err = s.store.AddMetadata(meta, s.cfg.MaxPendingMetadata)
+	switch {
+	case errors.Is(err, ErrMetadataFull):
+		return nil, "", errTooManyPending
 
-		getInvoice := fmt.Sprintf(
-			"%s://%s:%d/invoice?id=%s", s.cfg.Protocol, s.cfg.Host,
-			s.cfg.Port, id,
-		)
+	case err != nil:
+		return nil, "", err
+	}
+
+	return meta, data, nil
+}
 
-		resp := &PayResponse{
-			Callback:    getInvoice,
-			MinSendable: s.cfg.MinMsatSendable,
-			MaxSendable: s.cfg.MaxMsatSendable,
-			Metadata:    meta.data,
-			Tag:         TypePayRequest,
+// userMetadata builds the metadata for a payment to the given user. Fields
+// that the user doesn't set are taken from the config. The fallback is used
+// as the text/plain entry if no description is configured at all.
+func (s *Server) userMetadata(user *User, fallback string) (string, error) {
+	description, longDesc := s.cfg.Description, s.cfg.LongDescription
+	avatar := s.avatar
+	if user != nil {
+		if user.Description != "" {
+			description = user.Description
 		}
+		if user.LongDescription != "" {
+			longDesc = user.LongDescription
+		}
+		if user.avatarData != "" {
+			avatar = &MetadataEntry{
+				Type:    user.avatarType,
+				Content: user.avatarData,
+			}
+		}
+	}
+	if description == "" {
+		description = fallback
+	}
+
+	entries := []MetadataEntry{
+		{Type: MetadataPlainText, Content: description},
+	}
+	if longDesc != "" {
+		entries = append(entries, MetadataEntry{
+			Type: MetadataLongDesc, Content: longDesc,
+		})
+	}
+	if user != nil {
+		entries = append(entries, MetadataEntry{
+			Type:    MetadataIdentifier,
+			Content: s.lnAddressFor(user.Username),
+		})
+	}
+	if avatar != nil {
+		entries = append(entries, *avatar)
+	}
 
-		b, _ := json.Marshal(resp)
-		fmt.Fprintf(w, string(b))
+	meta, err := NewPayMetadata(entries...)
+	if err != nil {
+		return "", err
+	}
+
+	return meta.Raw, nil
+}
+
+// sendable returns the range of amounts that the given user accepts. If user
+// is nil, the server's defaults are returned.
+func (s *Server) sendable(user *User) (int64, int64) {
+	min, max := s.cfg.MinMsatSendable, s.cfg.MaxMsatSendable
+	if user == nil {
+		return min, max
+	}
+
+	if user.MinSendable != 0 {
+		min = user.MinSendable
+	}
+	if user.MaxSendable != 0 {
+		max = user.MaxSendable
+	}
+
+	return min, max
+}
+
+// lnAddressFor returns the Lightning Address of the given username.
+func (s *Server) lnAddressFor(username string) string {
+	addr := fmt.Sprintf("%s@%s", username, s.cfg.Host)
+	if s.cfg.Port != 80 {
+		addr += fmt.Sprintf(":%d", s.cfg.Port)
 	}
+
+	return addr
 }
 
 func (s *Server) invoice(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	id := r.Form.Get("id")
 	if id == "" {
-		http.Error(w, "expected 'id' field", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "expected 'id' field")
 		return
 	}
 
-	s.metadataMu.Lock()
-	meta, ok := s.paymentMetadata[id]
-	if !ok {
-		s.metadataMu.Unlock()
-		http.Error(w, "", http.StatusBadRequest)
+	meta, data, err := s.callbackMetadata(id)
+	switch {
+	case errors.Is(err, ErrMetadataNotFound):
+		writeError(
+			w, http.StatusNotFound, "unknown or expired 'id', "+
+				"please request a new invoice",
+		)
+		return
+
+	case errors.Is(err, ErrMetadataExpired):
+		writeError(
+			w, http.StatusGone, "pay request has expired, please "+
+				"request a new invoice",
+		)
+		return
+
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	delete(s.paymentMetadata, id)
-	s.metadataMu.Unlock()
 
 	amt := r.Form.Get("amount")
 	if amt == "" {
-		http.Error(w, "expected 'amount' field", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "expected 'amount' field")
 		return
 	}
 
 	milliSats, err := strconv.ParseInt(amt, 10, 64)
 	if err != nil {
-		http.Error(w, "expected 'amount' field", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "expected 'amount' field")
+		return
+	}
+
+	// If the metadata was handed out for a Lightning Address, the
+	// user's settings apply.
+	var user *User
+	if meta.Username != "" {
+		user, err = s.users.LookupUser(meta.Username)
+		if errors.Is(err, ErrUserNotFound) {
+			writeError(
+				w, http.StatusNotFound,
+				fmt.Sprintf("unknown user '%s'", meta.Username),
+			)
+			return
+		} else if err != nil {
+			writeError(
+				w, http.StatusInternalServerError, err.Error(),
+			)
+			return
+		}
+	}
+
+	minSendable, maxSendable := s.sendable(user)
+	if milliSats < minSendable || milliSats > maxSendable {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid "+
+			"amount. Expected an amount between %d and %d msat, "+
+			"got %d", minSendable, maxSendable, milliSats))
 		return
 	}
 
-	h := sha256.Sum256([]byte(html.UnescapeString(meta.data)))
-	ln := lntypes.Hash(h)
+	memo := "LNDURL-pay"
+	if user != nil && user.InvoiceMemo != "" {
+		memo = user.InvoiceMemo
+	}
+
+	// Only accept a comment if we advertised that we allow them.
+	var comment string
+	if s.cfg.CommentAllowed > 0 {
+		comment = r.Form.Get("comment")
+	}
+	if utf8.RuneCountInString(comment) > s.cfg.CommentAllowed {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("comment "+
+			"exceeds %d characters", s.cfg.CommentAllowed))
+		return
+	}
+
+	// The description hash commits to the exact metadata string that we
+	// handed out. If payer data was requested, it must be validated and
+	// then committed to along with the metadata.
+	description := data
+	payerData := r.Form.Get("payerdata")
+	switch {
+	case payerData != "":
+		_, err := ParsePayerData(
+			[]byte(payerData), s.cfg.PayerData, meta.AuthK1,
+		)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		description += payerData
+
+	case s.cfg.PayerData != nil:
+		// Run the validation against empty payer data so that
+		// missing mandatory fields are caught.
+		err := (&PayerData{}).Validate(s.cfg.PayerData, meta.AuthK1)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	h := sha256.Sum256([]byte(description))
+
+	// We pick the preimage ourselves so that we can use it to encrypt
+	// the success action.
+	var preimage lntypes.Preimage
+	if _, err := rand.Read(preimage[:]); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	successAction, err := s.successAction(preimage)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-	_, pr, err := s.lndClient.AddInvoice(ctx, &invoicesrpc.AddInvoiceData{
-		Memo:            "LNDURL-pay",
-		Value:           lnwire.MilliSatoshi(milliSats),
-		DescriptionHash: ln[:],
+	if !s.limiter.allowInvoice(w) {
+		return
+	}
+
+	createdAt := time.Now()
+	hash, pr, err := s.backend.AddInvoice(ctx, &InvoiceRequest{
+		Memo:            memo,
+		Preimage:        preimage,
+		AmountMsat:      milliSats,
+		Description:     description,
+		DescriptionHash: h,
+		Expiry:          invoiceExpiry,
 	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "invoice error")
+		return
+	}
+
+	inv := &Invoice{
+		Hash:         hash,
+		PayRequest:   pr,
+		MetadataID:   meta.ID,
+		MetadataHash: meta.Hash,
+		Username:     meta.Username,
+		AmountMsat:   milliSats,
+		Comment:      comment,
+		PayerData:    payerData,
+		State:        InvoiceStateIssued,
+		CreatedAt:    createdAt,
+		ExpiresAt:    createdAt.Add(invoiceExpiry),
+	}
+	if err := s.store.AddInvoice(inv); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.tracker.Track(inv)
+
+	if comment != "" {
+		log.Printf("Invoice %v for %d msat has comment: %q", hash,
+			milliSats, comment)
+	}
+
 	resp := &InvoiceResponse{
-		PayRequest: pr,
+		PayRequest:    pr,
+		SuccessAction: successAction,
+	}
+
+	writeJSON(w, resp)
+}
+
+// callbackMetadata returns the metadata of the callback with the given id and
+// the raw metadata string that was handed out with it. In stateless mode, the
+// metadata is rebuilt from the id. Otherwise, it is removed from the store so
+// that the callback can only be called once. ErrMetadataExpired is returned if
+// the metadata of the user has changed since it was handed out.
+func (s *Server) callbackMetadata(id string) (*Metadata, string, error) {
+	if s.stateless() {
+		return s.parseSignedMetadata(id)
+	}
+
+	meta, err := s.store.PopMetadata(id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The reaper may not have caught up with this entry yet.
+	if time.Since(meta.CreatedAt) > s.cfg.MetadataExpiry {
+		return nil, "", ErrMetadataExpired
+	}
+
+	// Only the hash of the metadata is stored, so we rebuild it from the
+	// config and the user.
+	var user *User
+	if meta.Username != "" {
+		user, err = s.users.LookupUser(meta.Username)
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, "", ErrMetadataNotFound
+		} else if err != nil {
+			return nil, "", err
+		}
 	}
+
+	data, err := s.userMetadata(user, meta.Fallback)
 	if err != nil {
-		http.Error(w, "invoice error", http.StatusInternalServerError)
+		return nil, "", err
+	}
+
+	// The wallet checks the invoice against the metadata that it was
+	// handed, so it must not have changed since.
+	if sha256.Sum256([]byte(data)) != meta.Hash {
+		return nil, "", ErrMetadataExpired
+	}
+
+	return meta, data, nil
+}
+
+// Invoices returns all invoices that have been issued by the server.
+func (s *Server) Invoices() ([]*Invoice, error) {
+	return s.store.ListInvoices()
+}
+
+// writeJSON serialises resp and writes it to w.
+func writeJSON(w http.ResponseWriter, resp interface{}) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	b, _ := json.Marshal(resp)
-	fmt.Fprintf(w, string(b))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
-func (s *Server) lnAddress(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "hellooooo")
+// writeError writes an LNURL error response with the given HTTP status code.
+func writeError(w http.ResponseWriter, code int, reason string) {
+	b, _ := json.Marshal(&Error{
+		Status: StatusError,
+		Reason: reason,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
 }
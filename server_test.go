@@ -0,0 +1,520 @@
+package lndurl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer is a server backed by a FakeBackend that serves its routes over
+// an httptest server.
+type testServer struct {
+	*Server
+
+	backend *FakeBackend
+	http    *httptest.Server
+}
+
+// newTestServer creates a regtest server for the user alice. The config can
+// be adjusted with modify before the server is created.
+func newTestServer(t *testing.T, modify func(cfg *Config)) *testServer {
+	cfg := &Config{
+		Protocol:            "http",
+		Username:            "alice",
+		Host:                "example.com",
+		Port:                80,
+		Network:             lndclient.NetworkRegtest,
+		MinMsatSendable:     1000,
+		MaxMsatSendable:     100000,
+		MinMsatWithdrawable: 1000,
+		MaxMsatWithdrawable: 50000,
+		MaxWithdrawFeeSat:   10,
+	}
+	if modify != nil {
+		modify(cfg)
+	}
+
+	backend, err := NewFakeBackend(&chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+
+	s, err := NewServer(cfg, backend)
+	require.NoError(t, err)
+
+	// Settled invoices are only picked up while the tracker runs.
+	require.NoError(t, s.tracker.Start())
+
+	ts := &testServer{
+		Server:  s,
+		backend: backend,
+		http:    httptest.NewServer(s.Handler()),
+	}
+	t.Cleanup(func() {
+		ts.http.Close()
+		require.NoError(t, s.Stop())
+		require.True(t, backend.Closed())
+	})
+
+	return ts
+}
+
+// get requests the path with the given query from the test server and
+// decodes the JSON response into resp. It returns the HTTP status code.
+func (ts *testServer) get(t *testing.T, path string, query url.Values,
+	resp interface{}) int {
+
+	u := ts.http.URL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	httpResp, err := http.Get(u)
+	require.NoError(t, err)
+	defer httpResp.Body.Close()
+
+	require.NoError(t, json.NewDecoder(httpResp.Body).Decode(resp))
+
+	return httpResp.StatusCode
+}
+
+// requestInvoice fetches the pay parameters from the given path and requests
+// an invoice for amt msat from the callback.
+func (ts *testServer) requestInvoice(t *testing.T, path string,
+	amt int64) (*PayResponse, *InvoiceResponse) {
+
+	var payResp PayResponse
+	require.Equal(t, http.StatusOK, ts.get(t, path, nil, &payResp))
+	require.EqualValues(t, TypePayRequest, payResp.Tag)
+
+	callback, err := url.Parse(payResp.Callback)
+	require.NoError(t, err)
+	query := callback.Query()
+	query.Set("amount", strconv.FormatInt(amt, 10))
+
+	var invResp InvoiceResponse
+	code := ts.get(t, callback.Path, query, &invResp)
+	require.Equal(t, http.StatusOK, code)
+
+	return &payResp, &invResp
+}
+
+// TestPayFlow tests requesting and paying an invoice through the static pay
+// code and through a Lightning Address.
+func TestPayFlow(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		username string
+	}{
+		{
+			name: "static pay code",
+			path: "/pay",
+		},
+		{
+			name:     "lightning address",
+			path:     lnAddressPath + "alice",
+			username: "alice",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+
+			payResp, invResp := s.requestInvoice(t, test.path, 5000)
+
+			inv, err := zpay32.Decode(
+				invResp.PayRequest, &chaincfg.RegressionNetParams,
+			)
+			require.NoError(t, err)
+			require.EqualValues(t, 5000, *inv.MilliSat)
+
+			descHash := sha256.Sum256([]byte(payResp.Metadata))
+			require.Equal(t, descHash, *inv.DescriptionHash)
+
+			hash := lntypes.Hash(*inv.PaymentHash)
+			require.NoError(t, s.backend.Settle(hash, 0))
+
+			require.Eventually(t, func() bool {
+				invoices, err := s.Invoices()
+				require.NoError(t, err)
+				require.Len(t, invoices, 1)
+
+				return invoices[0].State == InvoiceStateSettled
+			}, time.Second, 10*time.Millisecond)
+
+			if test.username == "" {
+				return
+			}
+
+			balance, err := s.ledger.Balance(test.username)
+			require.NoError(t, err)
+			require.EqualValues(t, 5000, balance)
+		})
+	}
+}
+
+// TestStoredMetadata tests that only the hash of the metadata is stored and
+// that callbacks are refused if the metadata has changed since it was handed
+// out.
+func TestStoredMetadata(t *testing.T) {
+	withDescription := func(cfg *Config) {
+		cfg.Description = "donations"
+	}
+
+	s := newTestServer(t, withDescription)
+	payResp, _ := s.requestInvoice(t, "/pay", 5000)
+
+	invoices, err := s.Invoices()
+	require.NoError(t, err)
+	require.Len(t, invoices, 1)
+	require.Equal(
+		t, lntypes.Hash(sha256.Sum256([]byte(payResp.Metadata))),
+		invoices[0].MetadataHash,
+	)
+
+	s = newTestServer(t, withDescription)
+	meta, data, err := s.storedMetadata(nil)
+	require.NoError(t, err)
+	require.Equal(t, lntypes.Hash(sha256.Sum256([]byte(data))), meta.Hash)
+
+	s.cfg.Description = "changed"
+	_, _, err = s.callbackMetadata(meta.ID)
+	require.ErrorIs(t, err, ErrMetadataExpired)
+}
+
+// TestPercentInResponses tests that texts with format verbs are returned
+// unchanged.
+func TestPercentInResponses(t *testing.T) {
+	const (
+		description = "100% of donations go to %s charity"
+		message     = "Thanks, 100% received"
+	)
+
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Description = description
+		cfg.SuccessMessage = message
+	})
+
+	payResp, invResp := s.requestInvoice(t, "/pay", 5000)
+
+	var meta [][]string
+	require.NoError(t, json.Unmarshal([]byte(payResp.Metadata), &meta))
+	require.Contains(t, meta, []string{"text/plain", description})
+
+	require.NotNil(t, invResp.SuccessAction)
+	require.Equal(t, message, invResp.SuccessAction.Message)
+}
+
+// TestInvoiceErrors tests that invalid invoice requests are rejected.
+func TestInvoiceErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(query url.Values)
+		code   int
+	}{
+		{
+			name:   "unknown id",
+			modify: func(query url.Values) { query.Set("id", "00") },
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "missing amount",
+			modify: func(query url.Values) { query.Del("amount") },
+			code:   http.StatusBadRequest,
+		},
+		{
+			name: "amount above max",
+			modify: func(query url.Values) {
+				query.Set("amount", "200000")
+			},
+			code: http.StatusBadRequest,
+		},
+	}
+
+	s := newTestServer(t, nil)
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			var payResp PayResponse
+			require.Equal(
+				t, http.StatusOK, s.get(t, "/pay", nil, &payResp),
+			)
+
+			callback, err := url.Parse(payResp.Callback)
+			require.NoError(t, err)
+			query := callback.Query()
+			query.Set("amount", "5000")
+			test.modify(query)
+
+			var errResp Error
+			code := s.get(t, callback.Path, query, &errResp)
+			require.Equal(t, test.code, code)
+			require.Equal(t, StatusError, errResp.Status)
+		})
+	}
+}
+
+// TestInvoiceLimit tests that only requests that create an invoice count
+// towards the global invoice creation limit.
+func TestInvoiceLimit(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.InvoiceRate = 0.001
+		cfg.InvoiceBurst = 1
+	})
+
+	invoiceQuery := func(amt string) (string, url.Values) {
+		var payResp PayResponse
+		code := s.get(t, "/pay", nil, &payResp)
+		require.Equal(t, http.StatusOK, code)
+
+		callback, err := url.Parse(payResp.Callback)
+		require.NoError(t, err)
+		query := callback.Query()
+		query.Set("amount", amt)
+
+		return callback.Path, query
+	}
+
+	var errResp Error
+	for i := 0; i < 3; i++ {
+		path, query := invoiceQuery("200000")
+		code := s.get(t, path, query, &errResp)
+		require.Equal(t, http.StatusBadRequest, code)
+	}
+
+	path, query := invoiceQuery("5000")
+	var invResp InvoiceResponse
+	require.Equal(t, http.StatusOK, s.get(t, path, query, &invResp))
+
+	path, query = invoiceQuery("5000")
+	code := s.get(t, path, query, &errResp)
+	require.Equal(t, http.StatusTooManyRequests, code)
+}
+
+// TestPendingMetadataLimit tests that concurrent pay requests can't hand out
+// more metadata than the configured max.
+func TestPendingMetadataLimit(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.MaxPendingMetadata = 5
+	})
+
+	codes := make(chan int, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var payResp PayResponse
+			codes <- s.get(t, "/pay", nil, &payResp)
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	var ok int
+	for code := range codes {
+		if code == http.StatusOK {
+			ok++
+			continue
+		}
+		require.Equal(t, http.StatusServiceUnavailable, code)
+	}
+	require.Equal(t, 5, ok)
+}
+
+// TestStatelessCallbacks tests that with a callback secret, metadata is fixed
+// per Lightning Address and callbacks can be called repeatedly on any server
+// that shares the secret.
+func TestStatelessCallbacks(t *testing.T) {
+	withSecret := func(secret string) func(cfg *Config) {
+		return func(cfg *Config) { cfg.CallbackSecret = secret }
+	}
+
+	secret := strings.Repeat("s", minCallbackSecretLen)
+	s := newTestServer(t, withSecret(secret))
+	replica := newTestServer(t, withSecret(secret))
+	other := newTestServer(t, withSecret(strings.Repeat("o", 32)))
+
+	path := lnAddressPath + "alice"
+	var payResp, again PayResponse
+	require.Equal(t, http.StatusOK, s.get(t, path, nil, &payResp))
+	require.Equal(t, http.StatusOK, s.get(t, path, nil, &again))
+	require.Equal(t, payResp.Metadata, again.Metadata)
+	require.Equal(
+		t, `[["text/plain","Payment to alice@example.com"],`+
+			`["text/identifier","alice@example.com"]]`,
+		payResp.Metadata,
+	)
+
+	// Nothing is stored for the pay request.
+	n, err := s.store.NumMetadata()
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	callback, err := url.Parse(payResp.Callback)
+	require.NoError(t, err)
+	query := callback.Query()
+	query.Set("amount", "5000")
+
+	// The callback can be called more than once, on any replica.
+	for _, ts := range []*testServer{s, replica, replica} {
+		var invResp InvoiceResponse
+		code := ts.get(t, callback.Path, query, &invResp)
+		require.Equal(t, http.StatusOK, code)
+
+		inv, err := zpay32.Decode(
+			invResp.PayRequest, &chaincfg.RegressionNetParams,
+		)
+		require.NoError(t, err)
+		require.Equal(
+			t, sha256.Sum256([]byte(payResp.Metadata)),
+			*inv.DescriptionHash,
+		)
+	}
+
+	id := query.Get("id")
+	tests := []struct {
+		name string
+		ts   *testServer
+		id   string
+		code int
+	}{
+		{
+			name: "other secret",
+			ts:   other,
+			id:   id,
+			code: http.StatusNotFound,
+		},
+		{
+			name: "tampered id",
+			ts:   s,
+			id:   strings.Replace(id, ".", "A.", 1),
+			code: http.StatusNotFound,
+		},
+		{
+			name: "expired",
+			ts:   s,
+			id: s.callbackToken(
+				"alice", payResp.Metadata,
+				time.Now().Add(-time.Second),
+			),
+			code: http.StatusGone,
+		},
+		{
+			name: "metadata changed",
+			ts:   s,
+			id: s.callbackToken(
+				"alice", "[]", time.Now().Add(time.Minute),
+			),
+			code: http.StatusGone,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			query.Set("id", test.id)
+
+			var errResp Error
+			code := test.ts.get(t, callback.Path, query, &errResp)
+			require.Equal(t, test.code, code)
+			require.Equal(t, StatusError, errResp.Status)
+		})
+	}
+}
+
+// TestWithdrawFlow tests that a withdraw link pays invoices through the
+// backend and that its budget is charged with the amount and the fee.
+func TestWithdrawFlow(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.backend.SetPayResult(1000, nil)
+
+	lnurl, err := s.NewWithdrawLink(20000, "test")
+	require.NoError(t, err)
+
+	link, err := DecodeURL(lnurl)
+	require.NoError(t, err)
+	linkURL, err := url.Parse(link)
+	require.NoError(t, err)
+
+	var withdrawResp WithdrawResponse
+	code := s.get(t, linkURL.Path, linkURL.Query(), &withdrawResp)
+	require.Equal(t, http.StatusOK, code)
+	require.EqualValues(t, 10000, withdrawResp.MaxWithdrawable)
+
+	// The invoice to withdraw to is created by the payer's node.
+	payer, err := NewFakeBackend(&chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+	_, pr, err := payer.AddInvoice(context.Background(), &InvoiceRequest{
+		Preimage:   lntypes.Preimage{1},
+		AmountMsat: 5000,
+		Expiry:     time.Hour,
+	})
+	require.NoError(t, err)
+
+	callback, err := url.Parse(withdrawResp.Callback)
+	require.NoError(t, err)
+
+	var statusResp StatusResponse
+	code = s.get(t, callback.Path, url.Values{
+		"k1": {withdrawResp.K1},
+		"pr": {pr},
+	}, &statusResp)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, StatusOK, statusResp.Status)
+
+	require.Eventually(t, func() bool {
+		return len(s.backend.Payments()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, pr, s.backend.Payments()[0])
+
+	// The unused fee reserve is refunded once the payment completes.
+	require.Eventually(t, func() bool {
+		code := s.get(t, linkURL.Path, linkURL.Query(), &withdrawResp)
+		require.Equal(t, http.StatusOK, code)
+
+		return withdrawResp.MaxWithdrawable == 4000
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestStartNetworkMismatch tests that the server refuses to start if the node
+// runs on a different network than configured.
+func TestStartNetworkMismatch(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Network = lndclient.NetworkTestnet
+		cfg.Protocol = "http"
+	})
+
+	err := s.Start(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "node runs on regtest")
+
+	// A testnet node is accepted for a testnet config.
+	backend, err := NewFakeBackend(&chaincfg.TestNet3Params)
+	require.NoError(t, err)
+
+	cfg := *s.cfg
+	cfg.ListenAddr = "localhost:0"
+	testnet, err := NewServer(&cfg, backend)
+	require.NoError(t, err)
+	require.NoError(t, testnet.Start(context.Background()))
+	require.NoError(t, testnet.Stop())
+}
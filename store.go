@@ -0,0 +1,217 @@
+package lndurl
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+var (
+	// ErrMetadataNotFound is returned when no metadata exists for the
+	// given callback id.
+	ErrMetadataNotFound = errors.New("metadata not found")
+
+	// ErrInvoiceNotFound is returned when no invoice exists for the given
+	// payment hash.
+	ErrInvoiceNotFound = errors.New("invoice not found")
+
+	// ErrMetadataFull is returned when metadata can't be added because
+	// the max number of outstanding entries has been reached.
+	ErrMetadataFull = errors.New("too many outstanding metadata entries")
+
+	// ErrDuplicateLedgerEntry is returned when a ledger entry for the
+	// same user and payment hash has already been recorded.
+	ErrDuplicateLedgerEntry = errors.New("duplicate ledger entry")
+)
+
+// Metadata is the metadata handed out in response to an LNURL-pay request. It
+// is identified by the id in the callback URL.
+type Metadata struct {
+	// ID is the callback id.
+	ID string `json:"id"`
+
+	// Hash is the SHA256 hash of the raw metadata string that was handed
+	// out. The string itself isn't stored, as it may embed a large
+	// avatar, but is rebuilt from the config and the user when the
+	// callback is called.
+	Hash lntypes.Hash `json:"hash"`
+
+	// Fallback is the text/plain entry of the metadata if neither the
+	// config nor the user set a description.
+	Fallback string `json:"fallback,omitempty"`
+
+	// AuthK1 is the challenge handed out for payer data auth, if it was
+	// requested.
+	AuthK1 string `json:"authK1,omitempty"`
+
+	// Username is the user whose Lightning Address was requested, if
+	// any.
+	Username string `json:"username,omitempty"`
+
+	// CreatedAt is the time at which the metadata was handed out.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// InvoiceState is the state of an issued invoice.
+type InvoiceState uint8
+
+const (
+	// InvoiceStateIssued is the state of an invoice that has been handed
+	// out but not yet paid.
+	InvoiceStateIssued InvoiceState = iota
+
+	// InvoiceStateSettled is the state of an invoice that has been paid.
+	InvoiceStateSettled
+
+	// InvoiceStateExpired is the state of an invoice that wasn't paid
+	// before it expired.
+	InvoiceStateExpired
+
+	// InvoiceStateCancelled is the state of an invoice that was cancelled
+	// before it expired.
+	InvoiceStateCancelled
+)
+
+// String returns a human readable representation of the state.
+func (s InvoiceState) String() string {
+	switch s {
+	case InvoiceStateIssued:
+		return "issued"
+
+	case InvoiceStateSettled:
+		return "settled"
+
+	case InvoiceStateExpired:
+		return "expired"
+
+	case InvoiceStateCancelled:
+		return "cancelled"
+
+	default:
+		return "unknown"
+	}
+}
+
+// Invoice is an invoice that was created in response to an LNURL-pay
+// callback.
+type Invoice struct {
+	// Hash is the payment hash of the invoice.
+	Hash lntypes.Hash `json:"hash"`
+
+	// PayRequest is the bech32 encoded invoice.
+	PayRequest string `json:"payRequest"`
+
+	// MetadataID is the id of the callback that the invoice was created
+	// for.
+	MetadataID string `json:"metadataId"`
+
+	// MetadataHash is the SHA256 hash of the raw metadata string that the
+	// invoice commits to.
+	MetadataHash lntypes.Hash `json:"metadataHash"`
+
+	// Username is the user that the invoice was issued for, if any.
+	Username string `json:"username,omitempty"`
+
+	// AmountMsat is the amount of the invoice.
+	AmountMsat int64 `json:"amountMsat"`
+
+	// Comment is the comment left by the payer, if any.
+	Comment string `json:"comment,omitempty"`
+
+	// PayerData is the raw payer data JSON sent by the payer, if any.
+	PayerData string `json:"payerData,omitempty"`
+
+	// State is the current state of the invoice.
+	State InvoiceState `json:"state"`
+
+	// CreatedAt is the time at which the invoice was created.
+	CreatedAt time.Time `json:"createdAt"`
+
+	// ExpiresAt is the time at which the invoice expires.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+
+	// SettledAt is the time at which the server learned that the invoice
+	// was settled.
+	SettledAt time.Time `json:"settledAt,omitempty"`
+}
+
+// WithdrawLink is a reusable LNURL-withdraw link that may pay out invoices
+// until its budget is exhausted.
+type WithdrawLink struct {
+	// K1 identifies the link.
+	K1 string `json:"k1"`
+
+	// Description is the default description of the withdrawn invoices.
+	Description string `json:"description"`
+
+	// Budget is the number of millisats that the link can still pay out.
+	// Any in-flight payments (and their max fee) have already been
+	// deducted.
+	Budget int64 `json:"budget"`
+
+	// Default is true for the link that is created for the configured
+	// withdraw budget.
+	Default bool `json:"default,omitempty"`
+
+	// CreatedAt is the time at which the link was created.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Store persists the state of the server's LNURL-pay and LNURL-withdraw flows.
+type Store interface {
+	// AddMetadata stores metadata that was handed out to a payer. If max
+	// is positive and at least max entries are outstanding, the metadata
+	// isn't stored and ErrMetadataFull is returned. Replacing an entry
+	// with the same id is always allowed.
+	AddMetadata(meta *Metadata, max int) error
+
+	// FetchMetadata returns the metadata with the given id.
+	FetchMetadata(id string) (*Metadata, error)
+
+	// PopMetadata atomically fetches and removes the metadata with the
+	// given id so that it can only be used once.
+	PopMetadata(id string) (*Metadata, error)
+
+	// DeleteExpiredMetadata removes all metadata that was created before
+	// the given time and returns the number of entries removed.
+	DeleteExpiredMetadata(before time.Time) (int, error)
+
+	// NumMetadata returns the number of outstanding metadata entries.
+	NumMetadata() (int, error)
+
+	// AddInvoice stores a newly issued invoice.
+	AddInvoice(inv *Invoice) error
+
+	// FetchInvoice returns the invoice with the given payment hash.
+	FetchInvoice(hash lntypes.Hash) (*Invoice, error)
+
+	// UpdateInvoiceState updates the state of the invoice with the given
+	// payment hash. If the new state is settled, the settle time is
+	// recorded as well.
+	UpdateInvoiceState(hash lntypes.Hash, state InvoiceState,
+		at time.Time) error
+
+	// ListInvoices returns all stored invoices.
+	ListInvoices() ([]*Invoice, error)
+
+	// AddLedgerEntry records an entry in a user's ledger. At most one
+	// entry may be recorded per user and payment hash, otherwise
+	// ErrDuplicateLedgerEntry is returned.
+	AddLedgerEntry(entry *LedgerEntry) error
+
+	// LedgerEntries returns all ledger entries of the given user ordered
+	// by time.
+	LedgerEntries(username string) ([]*LedgerEntry, error)
+
+	// PutWithdrawLink stores the given withdraw link, replacing any link
+	// with the same k1.
+	PutWithdrawLink(link *WithdrawLink) error
+
+	// ListWithdrawLinks returns all stored withdraw links ordered by
+	// creation time.
+	ListWithdrawLinks() ([]*WithdrawLink, error)
+
+	// Close releases any resources held by the store.
+	Close() error
+}
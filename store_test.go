@@ -0,0 +1,250 @@
+package lndurl
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStores runs the same set of tests against every Store implementation.
+func TestStores(t *testing.T) {
+	stores := []struct {
+		name string
+		new  func(t *testing.T) Store
+	}{
+		{
+			name: "memory",
+			new: func(_ *testing.T) Store {
+				return NewMemoryStore()
+			},
+		},
+		{
+			name: "bolt",
+			new: func(t *testing.T) Store {
+				store, err := NewBoltStore(
+					filepath.Join(t.TempDir(), "lndurl.db"),
+				)
+				require.NoError(t, err)
+
+				return store
+			},
+		},
+	}
+
+	for _, store := range stores {
+		store := store
+
+		t.Run(store.name+"/metadata", func(t *testing.T) {
+			testStoreMetadata(t, store.new(t))
+		})
+
+		t.Run(store.name+"/invoices", func(t *testing.T) {
+			testStoreInvoices(t, store.new(t))
+		})
+
+		t.Run(store.name+"/ledger", func(t *testing.T) {
+			testLedger(t, store.new(t))
+		})
+
+		t.Run(store.name+"/withdraw", func(t *testing.T) {
+			testStoreWithdrawLinks(t, store.new(t))
+		})
+	}
+}
+
+func testStoreMetadata(t *testing.T, store Store) {
+	defer store.Close()
+
+	_, err := store.FetchMetadata("unknown")
+	require.ErrorIs(t, err, ErrMetadataNotFound)
+
+	meta := &Metadata{
+		ID:        "abcd",
+		Hash:      lntypes.Hash{1},
+		Fallback:  "fallback",
+		AuthK1:    "k1",
+		CreatedAt: time.Unix(1000, 0),
+	}
+	require.NoError(t, store.AddMetadata(meta, 0))
+
+	fetched, err := store.FetchMetadata(meta.ID)
+	require.NoError(t, err)
+	require.Equal(t, meta.Hash, fetched.Hash)
+	require.Equal(t, meta.Fallback, fetched.Fallback)
+	require.Equal(t, meta.AuthK1, fetched.AuthK1)
+	require.True(t, meta.CreatedAt.Equal(fetched.CreatedAt))
+
+	// Storing the same id again replaces the entry.
+	require.NoError(t, store.AddMetadata(meta, 0))
+	n, err := store.NumMetadata()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// Popping the metadata returns it exactly once.
+	popped, err := store.PopMetadata(meta.ID)
+	require.NoError(t, err)
+	require.Equal(t, meta.ID, popped.ID)
+
+	_, err = store.PopMetadata(meta.ID)
+	require.ErrorIs(t, err, ErrMetadataNotFound)
+
+	// Only metadata created before the cut-off is deleted.
+	for i, createdAt := range []int64{1000, 2000, 3000} {
+		require.NoError(t, store.AddMetadata(&Metadata{
+			ID:        string(rune('a' + i)),
+			CreatedAt: time.Unix(createdAt, 0),
+		}, 0))
+	}
+
+	n, err = store.NumMetadata()
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	n, err = store.DeleteExpiredMetadata(time.Unix(2500, 0))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = store.NumMetadata()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	_, err = store.FetchMetadata("c")
+	require.NoError(t, err)
+
+	// No entries are added once the max is reached, but existing ones
+	// can still be replaced.
+	require.NoError(t, store.AddMetadata(&Metadata{ID: "d"}, 2))
+	err = store.AddMetadata(&Metadata{ID: "e"}, 2)
+	require.ErrorIs(t, err, ErrMetadataFull)
+	require.NoError(t, store.AddMetadata(&Metadata{ID: "d"}, 2))
+
+	n, err = store.NumMetadata()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+}
+
+// TestBoltStoreReopen tests that the number of metadata entries is restored
+// when a bolt store is reopened.
+func TestBoltStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lndurl.db")
+
+	store, err := NewBoltStore(path)
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, store.AddMetadata(&Metadata{ID: id}, 0))
+	}
+	require.NoError(t, store.Close())
+
+	store, err = NewBoltStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	n, err := store.NumMetadata()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	_, err = store.PopMetadata("a")
+	require.NoError(t, err)
+
+	n, err = store.NumMetadata()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func testStoreInvoices(t *testing.T, store Store) {
+	defer store.Close()
+
+	_, err := store.FetchInvoice(lntypes.Hash{1})
+	require.ErrorIs(t, err, ErrInvoiceNotFound)
+
+	err = store.UpdateInvoiceState(
+		lntypes.Hash{1}, InvoiceStateSettled, time.Now(),
+	)
+	require.ErrorIs(t, err, ErrInvoiceNotFound)
+
+	inv1 := &Invoice{
+		Hash:         lntypes.Hash{1},
+		PayRequest:   "lnbcrt1",
+		MetadataID:   "abcd",
+		MetadataHash: lntypes.Hash{3},
+		AmountMsat:   1000,
+		Comment:      "thanks!",
+		State:        InvoiceStateIssued,
+		CreatedAt:    time.Unix(1000, 0),
+	}
+	inv2 := &Invoice{
+		Hash:       lntypes.Hash{2},
+		PayRequest: "lnbcrt2",
+		AmountMsat: 2000,
+		State:      InvoiceStateIssued,
+		CreatedAt:  time.Unix(2000, 0),
+	}
+	require.NoError(t, store.AddInvoice(inv2))
+	require.NoError(t, store.AddInvoice(inv1))
+
+	fetched, err := store.FetchInvoice(inv1.Hash)
+	require.NoError(t, err)
+	require.Equal(t, inv1.PayRequest, fetched.PayRequest)
+	require.Equal(t, inv1.Comment, fetched.Comment)
+	require.Equal(t, inv1.MetadataHash, fetched.MetadataHash)
+	require.Equal(t, InvoiceStateIssued, fetched.State)
+
+	settledAt := time.Unix(3000, 0)
+	err = store.UpdateInvoiceState(
+		inv1.Hash, InvoiceStateSettled, settledAt,
+	)
+	require.NoError(t, err)
+
+	fetched, err = store.FetchInvoice(inv1.Hash)
+	require.NoError(t, err)
+	require.Equal(t, InvoiceStateSettled, fetched.State)
+	require.True(t, settledAt.Equal(fetched.SettledAt))
+
+	// Invoices are listed in the order in which they were created.
+	invoices, err := store.ListInvoices()
+	require.NoError(t, err)
+	require.Len(t, invoices, 2)
+	require.Equal(t, inv1.Hash, invoices[0].Hash)
+	require.Equal(t, inv2.Hash, invoices[1].Hash)
+}
+
+func testStoreWithdrawLinks(t *testing.T, store Store) {
+	defer store.Close()
+
+	links, err := store.ListWithdrawLinks()
+	require.NoError(t, err)
+	require.Empty(t, links)
+
+	link1 := &WithdrawLink{
+		K1:          "k1",
+		Description: "withdrawal",
+		Budget:      20000,
+		Default:     true,
+		CreatedAt:   time.Unix(1000, 0),
+	}
+	link2 := &WithdrawLink{
+		K1:        "k2",
+		Budget:    1000,
+		CreatedAt: time.Unix(2000, 0),
+	}
+	require.NoError(t, store.PutWithdrawLink(link2))
+	require.NoError(t, store.PutWithdrawLink(link1))
+
+	// Storing a link again updates its budget.
+	link1.Budget = 5000
+	require.NoError(t, store.PutWithdrawLink(link1))
+
+	// Links are listed in the order in which they were created.
+	links, err = store.ListWithdrawLinks()
+	require.NoError(t, err)
+	require.Len(t, links, 2)
+	require.Equal(t, link1.K1, links[0].K1)
+	require.Equal(t, link1.Description, links[0].Description)
+	require.EqualValues(t, 5000, links[0].Budget)
+	require.True(t, links[0].Default)
+	require.Equal(t, link2.K1, links[1].K1)
+	require.False(t, links[1].Default)
+}
@@ -0,0 +1,215 @@
+package lndurl
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"unicode/utf8"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// maxSuccessActionText is the max number of characters allowed in a
+	// success action message or description.
+	maxSuccessActionText = 144
+
+	// maxSuccessActionCiphertext is the max length of the base64 encoded
+	// ciphertext of an AES success action.
+	maxSuccessActionCiphertext = 4096
+
+	// successActionIVLength is the length of the base64 encoded IV of an
+	// AES success action.
+	successActionIVLength = 24
+)
+
+// NewMessageAction creates a success action that shows msg to the payer.
+func NewMessageAction(msg string) (*SuccessAction, error) {
+	action := &SuccessAction{
+		Tag:     SuccessActionMessage,
+		Message: msg,
+	}
+
+	return action, action.Validate()
+}
+
+// NewURLAction creates a success action that offers the payer to open the
+// given URL.
+func NewURLAction(description, u string) (*SuccessAction, error) {
+	action := &SuccessAction{
+		Tag:         SuccessActionURL,
+		Description: description,
+		URL:         u,
+	}
+
+	return action, action.Validate()
+}
+
+// NewAESAction creates a success action that hands the payer the given
+// plaintext, encrypted with the preimage of the invoice so that it can only
+// be read once the invoice has been paid.
+func NewAESAction(description, plaintext string,
+	preimage lntypes.Preimage) (*SuccessAction, error) {
+
+	var iv [aes.BlockSize]byte
+	if _, err := rand.Read(iv[:]); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(preimage[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Pad the plaintext to a multiple of the block size as per PKCS#7.
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(
+		[]byte(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...,
+	)
+
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv[:]).CryptBlocks(ciphertext, padded)
+
+	action := &SuccessAction{
+		Tag:         SuccessActionAES,
+		Description: description,
+		Ciphertext:  base64.StdEncoding.EncodeToString(ciphertext),
+		IV:          base64.StdEncoding.EncodeToString(iv[:]),
+	}
+
+	return action, action.Validate()
+}
+
+// Validate checks that the success action is well-formed.
+func (a *SuccessAction) Validate() error {
+	switch a.Tag {
+	case SuccessActionMessage:
+		return validateSuccessActionText("message", a.Message)
+
+	case SuccessActionURL:
+		if err := validateSuccessActionText(
+			"description", a.Description,
+		); err != nil {
+			return err
+		}
+
+		u, err := url.Parse(a.URL)
+		if err != nil {
+			return fmt.Errorf("invalid success action url: %w", err)
+		}
+
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return fmt.Errorf("success action url must be http(s)")
+		}
+
+		return nil
+
+	case SuccessActionAES:
+		if err := validateSuccessActionText(
+			"description", a.Description,
+		); err != nil {
+			return err
+		}
+
+		if len(a.Ciphertext) > maxSuccessActionCiphertext {
+			return fmt.Errorf("success action ciphertext exceeds "+
+				"%d characters", maxSuccessActionCiphertext)
+		}
+
+		if len(a.IV) != successActionIVLength {
+			return fmt.Errorf("success action iv must be %d "+
+				"characters", successActionIVLength)
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("unknown success action tag '%s'", a.Tag)
+	}
+}
+
+// Decrypt decrypts the ciphertext of an AES success action using the preimage
+// of the paid invoice.
+func (a *SuccessAction) Decrypt(preimage lntypes.Preimage) (string, error) {
+	if a.Tag != SuccessActionAES {
+		return "", fmt.Errorf("cannot decrypt a '%s' success action",
+			a.Tag)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(a.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("invalid ciphertext: %w", err)
+	}
+
+	iv, err := base64.StdEncoding.DecodeString(a.IV)
+	if err != nil {
+		return "", fmt.Errorf("invalid iv: %w", err)
+	}
+
+	if len(iv) != aes.BlockSize {
+		return "", errors.New("invalid iv length")
+	}
+
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", errors.New("invalid ciphertext length")
+	}
+
+	block, err := aes.NewCipher(preimage[:])
+	if err != nil {
+		return "", err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	// Strip and check the PKCS#7 padding. If the preimage is wrong then
+	// this will almost certainly fail.
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return "", errors.New("invalid padding")
+	}
+
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return "", errors.New("invalid padding")
+		}
+	}
+
+	return string(plaintext[:len(plaintext)-padding]), nil
+}
+
+func validateSuccessActionText(field, text string) error {
+	if utf8.RuneCountInString(text) > maxSuccessActionText {
+		return fmt.Errorf("success action %s exceeds %d characters",
+			field, maxSuccessActionText)
+	}
+
+	return nil
+}
+
+// successAction builds the success action configured for the server, if any.
+// The preimage is used to encrypt AES success actions.
+func (s *Server) successAction(preimage lntypes.Preimage) (*SuccessAction,
+	error) {
+
+	switch {
+	case s.cfg.SuccessSecret != "":
+		return NewAESAction(
+			s.cfg.SuccessDescription, s.cfg.SuccessSecret, preimage,
+		)
+
+	case s.cfg.SuccessURL != "":
+		return NewURLAction(s.cfg.SuccessDescription, s.cfg.SuccessURL)
+
+	case s.cfg.SuccessMessage != "":
+		return NewMessageAction(s.cfg.SuccessMessage)
+
+	default:
+		return nil, nil
+	}
+}
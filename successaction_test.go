@@ -0,0 +1,60 @@
+package lndurl
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAESSuccessAction(t *testing.T) {
+	var preimage lntypes.Preimage
+	_, err := rand.Read(preimage[:])
+	require.NoError(t, err)
+
+	secrets := []string{
+		"", "license key: ABCD-1234", strings.Repeat("x", 16),
+	}
+	for _, secret := range secrets {
+		action, err := NewAESAction("your key", secret, preimage)
+		require.NoError(t, err)
+		require.Equal(t, SuccessActionAES, action.Tag)
+
+		plaintext, err := action.Decrypt(preimage)
+		require.NoError(t, err)
+		require.Equal(t, secret, plaintext)
+	}
+
+	// Decrypting with the wrong preimage must not reveal the secret.
+	action, err := NewAESAction("your key", "secret", preimage)
+	require.NoError(t, err)
+
+	var wrong lntypes.Preimage
+	plaintext, err := action.Decrypt(wrong)
+	if err == nil {
+		require.NotEqual(t, "secret", plaintext)
+	}
+
+	// Secrets that are too long are rejected.
+	_, err = NewAESAction("", strings.Repeat("x", 4000), preimage)
+	require.Error(t, err)
+}
+
+func TestSuccessActionValidate(t *testing.T) {
+	_, err := NewMessageAction("thanks!")
+	require.NoError(t, err)
+
+	_, err = NewMessageAction(strings.Repeat("x", 145))
+	require.Error(t, err)
+
+	_, err = NewURLAction("download", "https://shop.com/dl/123")
+	require.NoError(t, err)
+
+	_, err = NewURLAction("download", "ftp://shop.com/dl/123")
+	require.Error(t, err)
+
+	err = (&SuccessAction{Tag: "unknown"}).Validate()
+	require.Error(t, err)
+}
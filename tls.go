@@ -0,0 +1,238 @@
+package lndurl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// selfSignedCertValidity is how long a generated self-signed
+	// certificate is valid for.
+	selfSignedCertValidity = 14 * 30 * 24 * time.Hour
+
+	// certReloadInterval is how often the certificate files are checked
+	// for changes.
+	certReloadInterval = 30 * time.Second
+)
+
+// certReloader holds the TLS certificate that the server serves and reloads
+// it when the certificate or key file changes on disk.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	reloadMu sync.Mutex
+	mu       sync.RWMutex
+}
+
+// newCertReloader loads the certificate and key from the given files.
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+
+	if _, err := r.maybeReload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the current certificate. It is used as the
+// GetCertificate callback of the tls.Config.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// maybeReload loads the certificate and key if either of the files was
+// modified since they were last loaded. It returns true if a new certificate
+// was loaded. If loading fails, the previous certificate is kept.
+func (r *certReloader) maybeReload() (bool, error) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false, err
+	}
+
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) &&
+		keyInfo.ModTime().Equal(r.keyMod) {
+
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("could not load tls cert: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+
+	return true, nil
+}
+
+// tlsConfig returns the TLS config used to serve HTTPS with the reloader's
+// certificate.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// watchCert periodically reloads the TLS certificate if its files changed.
+// It must be run as a goroutine.
+func (s *Server) watchCert() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := s.certs.maybeReload()
+			if err != nil {
+				log.Printf("Could not reload tls cert: %v", err)
+				continue
+			}
+
+			if reloaded {
+				log.Printf("Reloaded tls cert %s",
+					s.certs.certPath)
+			}
+
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// ensureSelfSignedCert generates a self-signed certificate for the given host
+// and writes it to certPath and keyPath, unless both files already exist.
+func ensureSelfSignedCert(certPath, keyPath, host string) error {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+
+	certPEM, keyPEM, err := genSelfSignedCert(host, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+
+	log.Printf("Generated self-signed tls cert %s", certPath)
+
+	return nil
+}
+
+// genSelfSignedCert generates a PEM encoded self-signed certificate and key
+// that are valid for the given host and for localhost.
+func genSelfSignedCert(host string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"lndurl autogenerated cert"},
+			CommonName:   host,
+		},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(selfSignedCertValidity),
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment |
+			x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+		},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses: []net.IP{
+			net.IPv4(127, 0, 0, 1), net.IPv6loopback,
+		},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if host != "localhost" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, template, &key.PublicKey, key,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der,
+	})
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: keyDER,
+	})
+
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,88 @@
+package lndurl
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSelfSignedCert tests that a self-signed cert is generated once and is
+// valid for the configured host.
+func TestSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls", "tls.cert")
+	keyPath := filepath.Join(dir, "tls", "tls.key")
+
+	require.NoError(t, ensureSelfSignedCert(certPath, keyPath, "example.com"))
+
+	certs, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+
+	tlsCert, err := certs.GetCertificate(nil)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	require.NoError(t, err)
+	require.NoError(t, cert.VerifyHostname("example.com"))
+	require.NoError(t, cert.VerifyHostname("127.0.0.1"))
+
+	// An existing cert must not be replaced.
+	before, err := ioutil.ReadFile(certPath)
+	require.NoError(t, err)
+	require.NoError(t, ensureSelfSignedCert(certPath, keyPath, "other.com"))
+	after, err := ioutil.ReadFile(certPath)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+// TestCertReload tests that the cert is only reloaded once its files change
+// and that a broken cert doesn't replace the current one.
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.cert")
+	keyPath := filepath.Join(dir, "tls.key")
+
+	require.NoError(t, ensureSelfSignedCert(certPath, keyPath, "localhost"))
+
+	certs, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	first, _ := certs.GetCertificate(nil)
+
+	reloaded, err := certs.maybeReload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	// Write a new cert pair and bump the modification time, in case the
+	// file system has a coarse resolution.
+	certPEM, keyPEM, err := genSelfSignedCert("localhost", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(certPath, certPEM, 0644))
+	require.NoError(t, ioutil.WriteFile(keyPath, keyPEM, 0600))
+
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+
+	reloaded, err = certs.maybeReload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+
+	second, _ := certs.GetCertificate(nil)
+	require.NotEqual(t, first.Certificate[0], second.Certificate[0])
+
+	// A half written cert is ignored.
+	require.NoError(t, ioutil.WriteFile(certPath, []byte("broken"), 0644))
+	modTime = modTime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+
+	_, err = certs.maybeReload()
+	require.Error(t, err)
+
+	current, _ := certs.GetCertificate(nil)
+	require.Equal(t, second, current)
+}
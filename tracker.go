@@ -0,0 +1,324 @@
+package lndurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// resubscribeInterval is how long we wait before re-subscribing to
+	// invoice updates after a subscription failed.
+	resubscribeInterval = 10 * time.Second
+
+	// invoiceCheckInterval is how often we look up invoices that have
+	// expired or whose last update could not be handled.
+	invoiceCheckInterval = time.Minute
+)
+
+// errSubscriptionClosed is returned when the backend closes an invoice
+// subscription.
+var errSubscriptionClosed = errors.New("invoice subscription closed")
+
+// InvoiceEvent notifies about an invoice that reached a final state.
+type InvoiceEvent struct {
+	// Invoice is the invoice in its new state. It links the payment back
+	// to the LNURL request that it was created for.
+	Invoice *Invoice
+
+	// AmountPaidMsat is the amount that was paid to a settled invoice.
+	AmountPaidMsat int64
+}
+
+// InvoiceHandler is called by the InvoiceTracker for every invoice that is
+// settled, expires or is cancelled. A handler may be called more than once
+// for the same invoice and must therefore be idempotent. If it returns an
+// error, the invoice is left in its previous state and the event is delivered
+// again once the tracker looks up the invoice again.
+type InvoiceHandler func(event *InvoiceEvent) error
+
+// InvoiceTracker follows the invoices issued by the server through the
+// backend and moves them from issued to settled, expired or cancelled. It
+// uses a single subscription to all of the backend's invoices and looks
+// invoices up individually only to catch up on missed updates and to find
+// out about expired invoices, which backends don't send updates for.
+type InvoiceTracker struct {
+	store   Store
+	backend Backend
+
+	handlers []InvoiceHandler
+
+	// tracked holds the invoices that have not reached a final state yet.
+	tracked map[lntypes.Hash]*trackedInvoice
+	mu      sync.Mutex
+
+	ctx    context.Context
+	cancel func()
+	wg     sync.WaitGroup
+}
+
+// trackedInvoice is an invoice that the tracker waits on.
+type trackedInvoice struct {
+	expiresAt time.Time
+
+	// recheck is set if the invoice must be looked up again because we
+	// may have missed an update or failed to handle it.
+	recheck bool
+}
+
+// NewInvoiceTracker creates a tracker for the invoices held in the given
+// store.
+func NewInvoiceTracker(store Store, backend Backend) *InvoiceTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &InvoiceTracker{
+		store:   store,
+		backend: backend,
+		tracked: make(map[lntypes.Hash]*trackedInvoice),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// AddHandler registers a handler that is notified about invoices reaching a
+// final state. Handlers must be added before the tracker is started.
+func (t *InvoiceTracker) AddHandler(handler InvoiceHandler) {
+	t.handlers = append(t.handlers, handler)
+}
+
+// Start resumes tracking all invoices that were still unpaid when the server
+// last shut down and subscribes to invoice updates.
+func (t *InvoiceTracker) Start() error {
+	invoices, err := t.store.ListInvoices()
+	if err != nil {
+		return err
+	}
+
+	for _, inv := range invoices {
+		if inv.State == InvoiceStateIssued {
+			t.Track(inv)
+		}
+	}
+
+	t.wg.Add(1)
+	go t.trackInvoices()
+
+	return nil
+}
+
+// Stop stops tracking all invoices and waits for the tracker's goroutines to
+// exit.
+func (t *InvoiceTracker) Stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// Track starts watching the given issued invoice until it reaches a final
+// state.
+func (t *InvoiceTracker) Track(inv *Invoice) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.tracked[inv.Hash]; ok {
+		return
+	}
+	t.tracked[inv.Hash] = &trackedInvoice{expiresAt: inv.ExpiresAt}
+}
+
+// trackInvoices subscribes to the backend's invoice updates, re-subscribing
+// if the subscription fails, until the tracker is stopped. It must be run as
+// a goroutine.
+func (t *InvoiceTracker) trackInvoices() {
+	defer t.wg.Done()
+
+	for {
+		err := t.subscribeInvoices()
+		if err == nil {
+			return
+		}
+		log.Printf("Invoice subscription failed, retrying in %v: %v",
+			resubscribeInterval, err)
+
+		select {
+		case <-time.After(resubscribeInterval):
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// subscribeInvoices handles the updates of a single subscription. Since any
+// update may have been missed while we weren't subscribed, all tracked
+// invoices are looked up once the subscription is established. It returns
+// nil once the tracker is stopped.
+func (t *InvoiceTracker) subscribeInvoices() error {
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+
+	updates, errChan, err := t.backend.SubscribeInvoices(ctx)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	for _, inv := range t.tracked {
+		inv.recheck = true
+	}
+	t.mu.Unlock()
+	t.checkInvoices(ctx)
+
+	ticker := time.NewTicker(invoiceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return errSubscriptionClosed
+			}
+
+			if err := t.handleUpdate(update); err != nil {
+				log.Printf("Could not handle update of "+
+					"invoice %v: %v", update.Hash, err)
+				t.markRecheck(update.Hash)
+			}
+
+		case err, ok := <-errChan:
+			if !ok || err == nil {
+				return errSubscriptionClosed
+			}
+
+			return err
+
+		case <-ticker.C:
+			t.checkInvoices(ctx)
+
+		case <-t.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// checkInvoices looks up the tracked invoices that have expired or that are
+// marked for a recheck and handles their current state. Invoices that can't
+// be checked stay marked and are checked again later.
+func (t *InvoiceTracker) checkInvoices(ctx context.Context) {
+	now := time.Now()
+
+	var hashes []lntypes.Hash
+	t.mu.Lock()
+	for hash, inv := range t.tracked {
+		expired := !inv.expiresAt.IsZero() && !now.Before(inv.expiresAt)
+		if inv.recheck || expired {
+			hashes = append(hashes, hash)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, hash := range hashes {
+		update, err := t.backend.LookupInvoice(ctx, hash)
+		if err == nil {
+			err = t.handleUpdate(*update)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Printf("Could not check invoice %v: %v", hash, err)
+			t.markRecheck(hash)
+			continue
+		}
+
+		t.mu.Lock()
+		if inv, ok := t.tracked[hash]; ok {
+			inv.recheck = false
+		}
+		t.mu.Unlock()
+	}
+}
+
+// markRecheck marks the invoice to be looked up again by the next check.
+func (t *InvoiceTracker) markRecheck(hash lntypes.Hash) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if inv, ok := t.tracked[hash]; ok {
+		inv.recheck = true
+	}
+}
+
+// handleUpdate moves the invoice to the state reported by the backend and
+// notifies the handlers. Updates of invoices that weren't issued by the
+// server or that already reached a final state are ignored.
+func (t *InvoiceTracker) handleUpdate(update InvoiceUpdate) error {
+	if update.State == InvoiceStateIssued {
+		return nil
+	}
+
+	inv, err := t.store.FetchInvoice(update.Hash)
+	if errors.Is(err, ErrInvoiceNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if inv.State != InvoiceStateIssued {
+		t.untrack(update.Hash)
+		return nil
+	}
+
+	now := time.Now()
+	event := &InvoiceEvent{
+		Invoice: inv,
+	}
+
+	switch update.State {
+	case InvoiceStateSettled:
+		inv.State = InvoiceStateSettled
+		inv.SettledAt = now
+		event.AmountPaidMsat = update.AmountPaidMsat
+
+	case InvoiceStateExpired:
+		inv.State = InvoiceStateExpired
+
+	// Some backends cancel invoices once they expire, so we use the
+	// invoice's expiry to tell the two apart.
+	case InvoiceStateCancelled:
+		inv.State = InvoiceStateCancelled
+		if !inv.ExpiresAt.IsZero() && !now.Before(inv.ExpiresAt) {
+			inv.State = InvoiceStateExpired
+		}
+
+	default:
+		return nil
+	}
+
+	for _, handler := range t.handlers {
+		if err := handler(event); err != nil {
+			return fmt.Errorf("invoice handler failed: %w", err)
+		}
+	}
+
+	err = t.store.UpdateInvoiceState(update.Hash, inv.State, now)
+	if err != nil {
+		return err
+	}
+	t.untrack(update.Hash)
+
+	return nil
+}
+
+// untrack stops watching the given invoice.
+func (t *InvoiceTracker) untrack(hash lntypes.Hash) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.tracked, hash)
+}
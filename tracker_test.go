@@ -0,0 +1,248 @@
+package lndurl
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// mockInvoices is a Backend that lets tests push invoice updates and set the
+// state that invoices are looked up in.
+type mockInvoices struct {
+	Backend
+
+	updates chan InvoiceUpdate
+	states  map[lntypes.Hash]InvoiceUpdate
+	mu      sync.Mutex
+}
+
+func newMockInvoices() *mockInvoices {
+	return &mockInvoices{
+		updates: make(chan InvoiceUpdate, 10),
+		states:  make(map[lntypes.Hash]InvoiceUpdate),
+	}
+}
+
+// SubscribeInvoices returns the update channel of the mock.
+func (m *mockInvoices) SubscribeInvoices(context.Context) (
+	<-chan InvoiceUpdate, <-chan error, error) {
+
+	return m.updates, make(chan error), nil
+}
+
+// LookupInvoice returns the state set for the given invoice, or an issued
+// state if none is set.
+func (m *mockInvoices) LookupInvoice(_ context.Context,
+	hash lntypes.Hash) (*InvoiceUpdate, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	update, ok := m.states[hash]
+	if !ok {
+		update = InvoiceUpdate{Hash: hash, State: InvoiceStateIssued}
+	}
+
+	return &update, nil
+}
+
+// setState sets the state that the given invoice is looked up in.
+func (m *mockInvoices) setState(update InvoiceUpdate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.states[update.Hash] = update
+}
+
+// TestInvoiceTracker tests that invoices are moved to the state reported by
+// the backend and that handlers are notified about it.
+func TestInvoiceTracker(t *testing.T) {
+	tests := []struct {
+		name      string
+		update    InvoiceUpdate
+		expiresAt time.Time
+		state     InvoiceState
+		credit    int64
+	}{
+		{
+			name: "settled",
+			update: InvoiceUpdate{
+				State:          InvoiceStateSettled,
+				AmountPaidMsat: 2000,
+			},
+			expiresAt: time.Now().Add(time.Hour),
+			state:     InvoiceStateSettled,
+			credit:    2000,
+		},
+		{
+			name: "cancelled",
+			update: InvoiceUpdate{
+				State: InvoiceStateCancelled,
+			},
+			expiresAt: time.Now().Add(time.Hour),
+			state:     InvoiceStateCancelled,
+		},
+		{
+			name: "expired",
+			update: InvoiceUpdate{
+				State: InvoiceStateCancelled,
+			},
+			expiresAt: time.Now().Add(-time.Minute),
+			state:     InvoiceStateExpired,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			invoices := newMockInvoices()
+			ledger := NewLedger(store)
+
+			events := make(chan *InvoiceEvent, 1)
+			tracker := NewInvoiceTracker(store, invoices)
+			tracker.AddHandler(ledger.HandleInvoiceEvent)
+			tracker.AddHandler(func(event *InvoiceEvent) error {
+				events <- event
+				return nil
+			})
+			defer tracker.Stop()
+
+			inv := &Invoice{
+				Hash:       lntypes.Hash{1},
+				MetadataID: "abcd",
+				Username:   "alice",
+				AmountMsat: 2500,
+				State:      InvoiceStateIssued,
+				ExpiresAt:  test.expiresAt,
+			}
+			require.NoError(t, store.AddInvoice(inv))
+
+			// Updates that don't move the invoice to a final
+			// state are ignored, as are updates of invoices that
+			// weren't issued by the server.
+			invoices.updates <- InvoiceUpdate{
+				Hash:  inv.Hash,
+				State: InvoiceStateIssued,
+			}
+			invoices.updates <- InvoiceUpdate{
+				Hash:           lntypes.Hash{2},
+				State:          InvoiceStateSettled,
+				AmountPaidMsat: 1000,
+			}
+
+			update := test.update
+			update.Hash = inv.Hash
+			invoices.updates <- update
+
+			require.NoError(t, tracker.Start())
+
+			var event *InvoiceEvent
+			select {
+			case event = <-events:
+			case <-time.After(time.Second):
+				t.Fatal("no invoice event")
+			}
+			require.Equal(t, test.state, event.Invoice.State)
+			require.Equal(t, inv.MetadataID, event.Invoice.MetadataID)
+			require.Equal(t, test.credit, event.AmountPaidMsat)
+
+			require.Eventually(t, func() bool {
+				stored, err := store.FetchInvoice(inv.Hash)
+				require.NoError(t, err)
+
+				return stored.State == test.state
+			}, time.Second, 10*time.Millisecond)
+
+			balance, err := ledger.Balance(inv.Username)
+			require.NoError(t, err)
+			require.Equal(t, test.credit, balance)
+		})
+	}
+}
+
+// TestInvoiceTrackerCatchUp tests that invoices that changed while the
+// tracker wasn't subscribed, including ones that expired, are picked up by
+// looking them up.
+func TestInvoiceTrackerCatchUp(t *testing.T) {
+	store := NewMemoryStore()
+	invoices := newMockInvoices()
+	ledger := NewLedger(store)
+
+	tracker := NewInvoiceTracker(store, invoices)
+	tracker.AddHandler(ledger.HandleInvoiceEvent)
+	defer tracker.Stop()
+
+	settled := &Invoice{
+		Hash:       lntypes.Hash{1},
+		Username:   "alice",
+		AmountMsat: 2500,
+		State:      InvoiceStateIssued,
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}
+	open := &Invoice{
+		Hash:       lntypes.Hash{2},
+		Username:   "alice",
+		AmountMsat: 1000,
+		State:      InvoiceStateIssued,
+		ExpiresAt:  time.Now().Add(time.Hour),
+	}
+	expired := &Invoice{
+		Hash:       lntypes.Hash{3},
+		Username:   "alice",
+		AmountMsat: 1000,
+		State:      InvoiceStateIssued,
+		ExpiresAt:  time.Now().Add(-time.Minute),
+	}
+	for _, inv := range []*Invoice{settled, open, expired} {
+		require.NoError(t, store.AddInvoice(inv))
+	}
+
+	invoices.setState(InvoiceUpdate{
+		Hash:           settled.Hash,
+		State:          InvoiceStateSettled,
+		AmountPaidMsat: 2500,
+	})
+	invoices.setState(InvoiceUpdate{
+		Hash:  expired.Hash,
+		State: InvoiceStateCancelled,
+	})
+
+	require.NoError(t, tracker.Start())
+
+	require.Eventually(t, func() bool {
+		stored, err := store.FetchInvoice(settled.Hash)
+		require.NoError(t, err)
+
+		return stored.State == InvoiceStateSettled
+	}, time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		stored, err := store.FetchInvoice(expired.Hash)
+		require.NoError(t, err)
+
+		return stored.State == InvoiceStateExpired
+	}, time.Second, 10*time.Millisecond)
+
+	balance, err := ledger.Balance("alice")
+	require.NoError(t, err)
+	require.EqualValues(t, 2500, balance)
+
+	// The invoice that is still open is tracked until it reaches a
+	// final state.
+	stored, err := store.FetchInvoice(open.Hash)
+	require.NoError(t, err)
+	require.Equal(t, InvoiceStateIssued, stored.State)
+
+	tracker.mu.Lock()
+	_, ok := tracker.tracked[open.Hash]
+	_, settledTracked := tracker.tracked[settled.Hash]
+	tracker.mu.Unlock()
+	require.True(t, ok)
+	require.False(t, settledTracked)
+}
@@ -1,5 +1,18 @@
 package lndurl
 
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidMetadata is returned if pay request metadata is malformed or
+// lacks required entries.
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
 type PayResponse struct {
 	// Callback is the URL from LN SERVICE which will accept the pay request
 	// parameters
@@ -16,25 +29,321 @@ type PayResponse struct {
 	// required to pass signature verification at a later step.
 	Metadata string `json:"metadata"` //[][2]string `json:"metadata"`
 
+	// CommentAllowed is the max number of characters that LN SERVICE
+	// accepts in the optional comment parameter of the callback. If zero,
+	// comments are not accepted.
+	CommentAllowed int `json:"commentAllowed,omitempty"`
+
+	// PayerData describes the data that LN SERVICE would like LN WALLET to
+	// send about the payer along with the callback.
+	PayerData *PayerDataSpec `json:"payerData,omitempty"`
+
 	// Type of LNURL
 	Tag Type `json:"tag"`
 }
 
+// MetadataType is the MIME type of a metadata entry.
+type MetadataType string
+
+const (
+	// MetadataPlainText is a short description of the payment. Metadata
+	// must contain exactly one text/plain entry.
+	MetadataPlainText MetadataType = "text/plain"
+
+	// MetadataLongDesc is a longer description of the payment.
+	MetadataLongDesc MetadataType = "text/long-desc"
+
+	// MetadataPNG is a base64 encoded PNG thumbnail.
+	MetadataPNG MetadataType = "image/png;base64"
+
+	// MetadataJPEG is a base64 encoded JPEG thumbnail.
+	MetadataJPEG MetadataType = "image/jpeg;base64"
+
+	// MetadataIdentifier is the Lightning Address that is paid.
+	MetadataIdentifier MetadataType = "text/identifier"
+
+	// MetadataEmail is the email style address that is paid.
+	MetadataEmail MetadataType = "text/email"
+)
+
+// MetadataEntry is a single [mime type, content] pair of pay request
+// metadata.
+type MetadataEntry struct {
+	Type    MetadataType
+	Content string
+}
+
+// PayMetadata is the parsed metadata of a pay request.
+type PayMetadata struct {
+	// Entries holds the entries in the order in which they appear in Raw.
+	// Entries of unknown types are kept as-is.
+	Entries []MetadataEntry
+
+	// Raw is the exact string that the entries were parsed from or
+	// encoded to. Invoice description hashes commit to it, so it must not
+	// be re-encoded.
+	Raw string
+}
+
+// ParseMetadata parses and validates the raw metadata string of a pay
+// request.
+func ParseMetadata(raw string) (*PayMetadata, error) {
+	var pairs [][]string
+	if err := json.Unmarshal([]byte(raw), &pairs); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+
+	m := &PayMetadata{
+		Entries: make([]MetadataEntry, 0, len(pairs)),
+		Raw:     raw,
+	}
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("%w: expected [type, content] "+
+				"pairs, got %d elements", ErrInvalidMetadata,
+				len(pair))
+		}
+
+		m.Entries = append(m.Entries, MetadataEntry{
+			Type:    MetadataType(pair[0]),
+			Content: pair[1],
+		})
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// NewPayMetadata validates the given entries and encodes them to the raw
+// metadata string.
+func NewPayMetadata(entries ...MetadataEntry) (*PayMetadata, error) {
+	m := &PayMetadata{Entries: entries}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	pairs := make([][2]string, 0, len(entries))
+	for _, entry := range entries {
+		pairs = append(pairs, [2]string{
+			string(entry.Type), entry.Content,
+		})
+	}
+
+	// The metadata is hashed as-is, so we don't want any HTML escaping.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(pairs); err != nil {
+		return nil, err
+	}
+	m.Raw = strings.TrimSuffix(buf.String(), "\n")
+
+	return m, nil
+}
+
+// Validate checks that the metadata has exactly one text/plain entry, at
+// most one image and at most one of text/identifier and text/email, and that
+// images are valid base64.
+func (m *PayMetadata) Validate() error {
+	counts := make(map[MetadataType]int)
+	for _, entry := range m.Entries {
+		counts[entry.Type]++
+
+		switch entry.Type {
+		case MetadataPNG, MetadataJPEG:
+			_, err := base64.StdEncoding.DecodeString(entry.Content)
+			if err != nil {
+				return fmt.Errorf("%w: %s entry is not "+
+					"valid base64", ErrInvalidMetadata,
+					entry.Type)
+			}
+		}
+	}
+
+	switch {
+	case counts[MetadataPlainText] != 1:
+		return fmt.Errorf("%w: expected exactly one %s entry, got %d",
+			ErrInvalidMetadata, MetadataPlainText,
+			counts[MetadataPlainText])
+
+	case counts[MetadataLongDesc] > 1:
+		return fmt.Errorf("%w: more than one %s entry",
+			ErrInvalidMetadata, MetadataLongDesc)
+
+	case counts[MetadataPNG]+counts[MetadataJPEG] > 1:
+		return fmt.Errorf("%w: more than one image",
+			ErrInvalidMetadata)
+
+	case counts[MetadataIdentifier]+counts[MetadataEmail] > 1:
+		return fmt.Errorf("%w: more than one of %s and %s",
+			ErrInvalidMetadata, MetadataIdentifier, MetadataEmail)
+	}
+
+	return nil
+}
+
+// Get returns the content of the first entry of the given type.
+func (m *PayMetadata) Get(t MetadataType) (string, bool) {
+	for _, entry := range m.Entries {
+		if entry.Type == t {
+			return entry.Content, true
+		}
+	}
+
+	return "", false
+}
+
+// Description returns the text/plain description.
+func (m *PayMetadata) Description() string {
+	description, _ := m.Get(MetadataPlainText)
+	return description
+}
+
+type PayerDataSpec struct {
+	// Name requests the payer's name.
+	Name *PayerDataField `json:"name,omitempty"`
+
+	// Pubkey requests a hex encoded public key identifying the payer.
+	Pubkey *PayerDataField `json:"pubkey,omitempty"`
+
+	// Identifier requests an identifier of the payer, such as their
+	// Lightning Address.
+	Identifier *PayerDataField `json:"identifier,omitempty"`
+
+	// Email requests the payer's email address.
+	Email *PayerDataField `json:"email,omitempty"`
+
+	// Auth requests an LNURL-auth signature over K1 by the payer's linking
+	// key for the LN SERVICE domain.
+	Auth *PayerDataAuthField `json:"auth,omitempty"`
+}
+
+type PayerDataField struct {
+	// Mandatory is true if LN SERVICE will reject the callback if the
+	// field is not provided.
+	Mandatory bool `json:"mandatory"`
+}
+
+type PayerDataAuthField struct {
+	// Mandatory is true if LN SERVICE will reject the callback if the
+	// field is not provided.
+	Mandatory bool `json:"mandatory"`
+
+	// K1 is the hex encoded challenge that the payer must sign.
+	K1 string `json:"k1"`
+}
+
+type PayerData struct {
+	Name       string         `json:"name,omitempty"`
+	Pubkey     string         `json:"pubkey,omitempty"`
+	Identifier string         `json:"identifier,omitempty"`
+	Email      string         `json:"email,omitempty"`
+	Auth       *PayerDataAuth `json:"auth,omitempty"`
+}
+
+type PayerDataAuth struct {
+	// Key is the hex encoded linking key of the payer.
+	Key string `json:"key"`
+
+	// K1 is the challenge provided in the PayerDataAuthField.
+	K1 string `json:"k1"`
+
+	// Sig is the hex encoded DER signature over K1 by Key.
+	Sig string `json:"sig"`
+}
+
 type InvoiceResponse struct {
 	// PayRequest is a bech32-serialized lightning invoice.
 	PayRequest string `json:"pr"`
 
 	// Routes an empty array.
 	Routes []string `json:"routes"`
+
+	// SuccessAction is an optional action that LN WALLET should perform
+	// once the invoice has been paid.
+	SuccessAction *SuccessAction `json:"successAction,omitempty"`
+}
+
+type SuccessAction struct {
+	// Tag is the type of success action.
+	Tag SuccessActionTag `json:"tag"`
+
+	// Message is shown to the user by a "message" success action.
+	Message string `json:"message,omitempty"`
+
+	// Description is shown to the user along with the URL or the
+	// decrypted plaintext of "url" and "aes" success actions.
+	Description string `json:"description,omitempty"`
+
+	// URL is the URL that LN WALLET should offer to open for a "url"
+	// success action. It must have the same domain as the callback.
+	URL string `json:"url,omitempty"`
+
+	// Ciphertext is the base64 encoded AES-256-CBC encrypted secret of an
+	// "aes" success action. The key is the payment preimage.
+	Ciphertext string `json:"ciphertext,omitempty"`
+
+	// IV is the base64 encoded initialisation vector of an "aes" success
+	// action.
+	IV string `json:"iv,omitempty"`
+}
+
+type SuccessActionTag string
+
+const (
+	SuccessActionMessage SuccessActionTag = "message"
+	SuccessActionURL     SuccessActionTag = "url"
+	SuccessActionAES     SuccessActionTag = "aes"
+)
+
+type WithdrawResponse struct {
+	// Tag is the type of LNURL.
+	Tag Type `json:"tag"`
+
+	// Callback is the URL which LN WALLET can call once it has created an
+	// invoice to be paid.
+	Callback string `json:"callback"`
+
+	// K1 is a random or non-random string which identifies the withdraw
+	// link when the callback URL is called.
+	K1 string `json:"k1"`
+
+	// DefaultDescription is the default description for the invoice that
+	// LN WALLET should create.
+	DefaultDescription string `json:"defaultDescription"`
+
+	// MinWithdrawable is the min amount (in millisatoshis) that the user
+	// can withdraw from LN SERVICE, or 0.
+	MinWithdrawable int64 `json:"minWithdrawable"`
+
+	// MaxWithdrawable is the max amount (in millisatoshis) that the user
+	// can withdraw from LN SERVICE, or equal to MinWithdrawable if the
+	// user has no choice over the amount.
+	MaxWithdrawable int64 `json:"maxWithdrawable"`
 }
 
 type Type string
 
 const (
-	TypePayRequest = "payRequest"
+	TypePayRequest      = "payRequest"
+	TypeWithdrawRequest = "withdrawRequest"
+)
+
+const (
+	StatusOK    = "OK"
+	StatusError = "ERROR"
 )
 
 type Error struct {
 	Status string `json:"status"`
 	Reason string `json:"reason"`
 }
+
+// StatusResponse is returned by callbacks that only need to tell LN WALLET
+// whether its request was accepted.
+type StatusResponse struct {
+	Status string `json:"status"`
+}
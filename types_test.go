@@ -0,0 +1,123 @@
+package lndurl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseMetadata tests that metadata is parsed into entries and that
+// metadata without the required entries is rejected.
+func TestParseMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		description string
+		entries     int
+		err         bool
+	}{
+		{
+			name:        "text/plain only",
+			raw:         `[["text/plain","hi"]]`,
+			description: "hi",
+			entries:     1,
+		},
+		{
+			name: "all known types",
+			raw: `[["text/plain","hi"],` +
+				`["text/long-desc","hello"],` +
+				`["image/jpeg;base64","aGk="],` +
+				`["text/identifier","alice@example.com"]]`,
+			description: "hi",
+			entries:     4,
+		},
+		{
+			name: "unknown types are kept",
+			raw: `[["text/plain","hi"],` +
+				`["application/x-other","?"]]`,
+			description: "hi",
+			entries:     2,
+		},
+		{
+			name: "not an array of pairs",
+			raw:  `{"text/plain":"hi"}`,
+			err:  true,
+		},
+		{
+			name: "entry is not a pair",
+			raw:  `[["text/plain","hi","there"]]`,
+			err:  true,
+		},
+		{
+			name: "no text/plain",
+			raw:  `[["text/long-desc","hello"]]`,
+			err:  true,
+		},
+		{
+			name: "two text/plain",
+			raw:  `[["text/plain","hi"],["text/plain","hi"]]`,
+			err:  true,
+		},
+		{
+			name: "two images",
+			raw: `[["text/plain","hi"],` +
+				`["image/png;base64","aGk="],` +
+				`["image/jpeg;base64","aGk="]]`,
+			err: true,
+		},
+		{
+			name: "invalid base64 image",
+			raw:  `[["text/plain","hi"],["image/png;base64","!"]]`,
+			err:  true,
+		},
+		{
+			name: "identifier and email",
+			raw: `[["text/plain","hi"],["text/email","a@b.c"],` +
+				`["text/identifier","a@b.c"]]`,
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			meta, err := ParseMetadata(test.raw)
+			if test.err {
+				require.ErrorIs(t, err, ErrInvalidMetadata)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.raw, meta.Raw)
+			require.Equal(t, test.description, meta.Description())
+			require.Len(t, meta.Entries, test.entries)
+		})
+	}
+}
+
+// TestNewPayMetadata tests that encoded metadata parses back to the same
+// entries without any HTML escaping.
+func TestNewPayMetadata(t *testing.T) {
+	entries := []MetadataEntry{
+		{Type: MetadataPlainText, Content: `Pay "alice" <3`},
+		{Type: MetadataEmail, Content: "alice@example.com"},
+	}
+
+	meta, err := NewPayMetadata(entries...)
+	require.NoError(t, err)
+	require.Equal(
+		t, `[["text/plain","Pay \"alice\" <3"],`+
+			`["text/email","alice@example.com"]]`, meta.Raw,
+	)
+
+	parsed, err := ParseMetadata(meta.Raw)
+	require.NoError(t, err)
+	require.Equal(t, entries, parsed.Entries)
+
+	email, ok := parsed.Get(MetadataEmail)
+	require.True(t, ok)
+	require.Equal(t, "alice@example.com", email)
+
+	_, err = NewPayMetadata(entries[1])
+	require.ErrorIs(t, err, ErrInvalidMetadata)
+}
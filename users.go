@@ -0,0 +1,278 @@
+package lndurl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrUserNotFound is returned when a username is not known to the
+	// registry.
+	ErrUserNotFound = errors.New("user not found")
+
+	// usernameRegex matches the usernames allowed by LUD-16.
+	usernameRegex = regexp.MustCompile(`^[a-z0-9\-_.]+$`)
+
+	// pngMagic is the signature that every PNG file starts with.
+	pngMagic = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+	// jpegMagic is the start of image marker that every JPEG file starts
+	// with, followed by the first byte of the next marker.
+	jpegMagic = []byte{0xff, 0xd8, 0xff}
+)
+
+// MaxAvatarSize is the max size (in bytes) of an avatar image. Avatars are
+// embedded in the metadata of every pay request, so they should be small
+// thumbnails.
+const MaxAvatarSize = 128 * 1024
+
+// User is a Lightning Address hosted by the server.
+type User struct {
+	// Username is the local part of the Lightning Address.
+	Username string `json:"username"`
+
+	// MinSendable and MaxSendable bound the amount (in millisatoshis)
+	// that the user accepts. If zero, the server defaults are used.
+	MinSendable int64 `json:"minSendable,omitempty"`
+	MaxSendable int64 `json:"maxSendable,omitempty"`
+
+	// Description is the text/plain metadata shown to payers.
+	Description string `json:"description,omitempty"`
+
+	// LongDescription is the text/long-desc metadata that wallets may
+	// show to payers in addition to the description.
+	LongDescription string `json:"longDescription,omitempty"`
+
+	// Avatar is the path to a PNG or JPEG image that is shown to payers.
+	// It must not be larger than MaxAvatarSize.
+	Avatar string `json:"avatar,omitempty"`
+
+	// InvoiceMemo is the memo stored with the user's invoices in the
+	// node's database.
+	InvoiceMemo string `json:"invoiceMemo,omitempty"`
+
+	// avatarData is the base64 encoded content of the Avatar file.
+	avatarData string
+
+	// avatarType is the metadata type of the Avatar file.
+	avatarType MetadataType
+}
+
+// UserRegistry provides the set of Lightning Addresses hosted by the server.
+type UserRegistry interface {
+	// LookupUser returns the user with the given username or
+	// ErrUserNotFound.
+	LookupUser(username string) (*User, error)
+
+	// Users returns all known users.
+	Users() ([]*User, error)
+}
+
+// validate checks the user's fields and loads its avatar, if any.
+func (u *User) validate() error {
+	if !usernameRegex.MatchString(u.Username) {
+		return fmt.Errorf("invalid username '%s': only a-z, 0-9, '-', "+
+			"'_' and '.' are allowed", u.Username)
+	}
+
+	if u.MinSendable < 0 || u.MaxSendable < 0 {
+		return fmt.Errorf("user %s: sendable amounts must not be "+
+			"negative", u.Username)
+	}
+
+	if u.MaxSendable != 0 && u.MinSendable > u.MaxSendable {
+		return fmt.Errorf("user %s: min sendable is greater than max "+
+			"sendable", u.Username)
+	}
+
+	if u.Avatar == "" {
+		return nil
+	}
+
+	avatar, err := loadAvatar(u.Avatar)
+	if err != nil {
+		return fmt.Errorf("user %s: %w", u.Username, err)
+	}
+	u.avatarType, u.avatarData = avatar.Type, avatar.Content
+
+	return nil
+}
+
+// loadAvatar reads the PNG or JPEG image at the given path and returns it as
+// a base64 encoded metadata entry.
+func loadAvatar(path string) (*MetadataEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read avatar: %w", err)
+	}
+	if info.Size() > MaxAvatarSize {
+		return nil, fmt.Errorf("avatar %s is larger than %d bytes",
+			path, MaxAvatarSize)
+	}
+
+	avatar, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read avatar: %w", err)
+	}
+
+	var imageType MetadataType
+	switch {
+	case bytes.HasPrefix(avatar, pngMagic):
+		imageType = MetadataPNG
+
+	case bytes.HasPrefix(avatar, jpegMagic):
+		imageType = MetadataJPEG
+
+	default:
+		return nil, fmt.Errorf("avatar %s must be a PNG or JPEG "+
+			"image", path)
+	}
+
+	return &MetadataEntry{
+		Type:    imageType,
+		Content: base64.StdEncoding.EncodeToString(avatar),
+	}, nil
+}
+
+// newUserRegistry creates the user registry described by the config. Users are
+// loaded from the UsersFile if set. Otherwise, a registry holding only the
+// configured Username is created.
+func newUserRegistry(cfg *Config) (UserRegistry, error) {
+	switch {
+	case cfg.UsersFile != "":
+		return NewFileUserRegistry(cfg.UsersFile)
+
+	case cfg.Username != "":
+		return NewStaticUserRegistry(&User{Username: cfg.Username})
+
+	default:
+		return NewStaticUserRegistry()
+	}
+}
+
+// StaticUserRegistry is a UserRegistry with a fixed set of users.
+type StaticUserRegistry struct {
+	users map[string]*User
+}
+
+// A compile time check to ensure that StaticUserRegistry implements
+// UserRegistry.
+var _ UserRegistry = (*StaticUserRegistry)(nil)
+
+// NewStaticUserRegistry creates a registry holding the given users.
+func NewStaticUserRegistry(users ...*User) (*StaticUserRegistry, error) {
+	r := &StaticUserRegistry{
+		users: make(map[string]*User, len(users)),
+	}
+
+	for _, user := range users {
+		if err := user.validate(); err != nil {
+			return nil, err
+		}
+
+		if _, ok := r.users[user.Username]; ok {
+			return nil, fmt.Errorf("duplicate username '%s'",
+				user.Username)
+		}
+		r.users[user.Username] = user
+	}
+
+	return r, nil
+}
+
+// LookupUser returns the user with the given username.
+func (r *StaticUserRegistry) LookupUser(username string) (*User, error) {
+	user, ok := r.users[strings.ToLower(username)]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+// Users returns all known users ordered by username.
+func (r *StaticUserRegistry) Users() ([]*User, error) {
+	users := make([]*User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users, nil
+}
+
+// FileUserRegistry is a UserRegistry that is loaded from a JSON file holding
+// an array of users. The file can be re-read with Reload.
+type FileUserRegistry struct {
+	path string
+
+	registry *StaticUserRegistry
+	mu       sync.RWMutex
+}
+
+// A compile time check to ensure that FileUserRegistry implements
+// UserRegistry.
+var _ UserRegistry = (*FileUserRegistry)(nil)
+
+// NewFileUserRegistry loads the users from the JSON file at the given path.
+func NewFileUserRegistry(path string) (*FileUserRegistry, error) {
+	r := &FileUserRegistry{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload re-reads the users file. The previous set of users is kept if the
+// file is invalid.
+func (r *FileUserRegistry) Reload() error {
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("could not read users file: %w", err)
+	}
+
+	var users []*User
+	if err := json.Unmarshal(b, &users); err != nil {
+		return fmt.Errorf("could not parse users file: %w", err)
+	}
+
+	registry, err := NewStaticUserRegistry(users...)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.registry = registry
+	r.mu.Unlock()
+
+	return nil
+}
+
+// LookupUser returns the user with the given username.
+func (r *FileUserRegistry) LookupUser(username string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.registry.LookupUser(username)
+}
+
+// Users returns all known users ordered by username.
+func (r *FileUserRegistry) Users() ([]*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.registry.Users()
+}
@@ -0,0 +1,177 @@
+package lndurl
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileUserRegistry(t *testing.T) {
+	dir := t.TempDir()
+
+	avatar := filepath.Join(dir, "avatar.png")
+	require.NoError(t, ioutil.WriteFile(
+		avatar, append(pngMagic, 1, 2, 3), 0600,
+	))
+
+	notPNG := filepath.Join(dir, "avatar.gif")
+	require.NoError(t, ioutil.WriteFile(notPNG, []byte("GIF89a"), 0600))
+
+	usersFile := filepath.Join(dir, "users.json")
+	writeUsers := func(users ...*User) {
+		b, err := json.Marshal(users)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(usersFile, b, 0600))
+	}
+
+	writeUsers(
+		&User{Username: "bob", MaxSendable: 5000},
+		&User{Username: "alice", Avatar: avatar, InvoiceMemo: "hi"},
+	)
+
+	registry, err := NewFileUserRegistry(usersFile)
+	require.NoError(t, err)
+
+	users, err := registry.Users()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "alice", users[0].Username)
+	require.NotEmpty(t, users[0].avatarData)
+
+	// Lookups are case insensitive.
+	user, err := registry.LookupUser("BOB")
+	require.NoError(t, err)
+	require.EqualValues(t, 5000, user.MaxSendable)
+
+	_, err = registry.LookupUser("carol")
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	// An invalid file is rejected on reload and the old users are kept.
+	invalid := [][]*User{
+		{{Username: "Bob"}},
+		{{Username: "bob"}, {Username: "bob"}},
+		{{Username: "bob", MinSendable: 10, MaxSendable: 5}},
+		{{Username: "bob", Avatar: notPNG}},
+	}
+	for _, users := range invalid {
+		writeUsers(users...)
+		require.Error(t, registry.Reload())
+	}
+
+	_, err = registry.LookupUser("alice")
+	require.NoError(t, err)
+}
+
+func TestUserMetadata(t *testing.T) {
+	s := &Server{cfg: &Config{Host: "example.com", Port: 80}}
+
+	meta, err := s.userMetadata(&User{
+		Username:    "alice",
+		Description: `Pay "alice" <3`,
+	}, "fallback")
+	require.NoError(t, err)
+	require.Equal(
+		t, `[["text/plain","Pay \"alice\" <3"],`+
+			`["text/identifier","alice@example.com"]]`, meta,
+	)
+
+	meta, err = s.userMetadata(&User{Username: "bob"}, "fallback")
+	require.NoError(t, err)
+	require.Equal(
+		t, `[["text/plain","fallback"],`+
+			`["text/identifier","bob@example.com"]]`, meta,
+	)
+
+	meta, err = s.userMetadata(nil, "fallback")
+	require.NoError(t, err)
+	require.Equal(t, `[["text/plain","fallback"]]`, meta)
+
+	// Users without their own description and avatar get the configured
+	// ones.
+	s.cfg.Description = "Donations"
+	s.cfg.LongDescription = "Thanks for your support!"
+	s.avatar = &MetadataEntry{Type: MetadataJPEG, Content: "/9j/"}
+
+	meta, err = s.userMetadata(&User{
+		Username:   "alice",
+		avatarType: MetadataPNG,
+		avatarData: "iVBO",
+	}, "fallback")
+	require.NoError(t, err)
+	require.Equal(
+		t, `[["text/plain","Donations"],`+
+			`["text/long-desc","Thanks for your support!"],`+
+			`["text/identifier","alice@example.com"],`+
+			`["image/png;base64","iVBO"]]`, meta,
+	)
+
+	meta, err = s.userMetadata(nil, "fallback")
+	require.NoError(t, err)
+	require.Equal(
+		t, `[["text/plain","Donations"],`+
+			`["text/long-desc","Thanks for your support!"],`+
+			`["image/jpeg;base64","/9j/"]]`, meta,
+	)
+}
+
+func TestLoadAvatar(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		content  []byte
+		expected MetadataType
+		err      bool
+	}{
+		{
+			name:     "png",
+			content:  append(pngMagic, 1, 2, 3),
+			expected: MetadataPNG,
+		},
+		{
+			name:     "jpeg",
+			content:  append(jpegMagic, 0xe0, 1, 2, 3),
+			expected: MetadataJPEG,
+		},
+		{
+			name:    "gif",
+			content: []byte("GIF89a"),
+			err:     true,
+		},
+		{
+			name: "too large",
+			content: append(
+				pngMagic, make([]byte, MaxAvatarSize)...,
+			),
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name)
+			require.NoError(t, ioutil.WriteFile(
+				path, test.content, 0600,
+			))
+
+			avatar, err := loadAvatar(path)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.expected, avatar.Type)
+			require.Equal(
+				t, base64.StdEncoding.EncodeToString(
+					test.content,
+				), avatar.Content,
+			)
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package lndurl
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader is the header that carries the hex encoded
+	// HMAC-SHA256 of the request body, keyed with the endpoint's secret.
+	WebhookSignatureHeader = "X-Lndurl-Signature"
+
+	// WebhookEventSettled is the type of the event sent when an invoice
+	// is settled.
+	WebhookEventSettled = "invoice.settled"
+
+	// webhookTimeout is the timeout of a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+
+	// webhookInitialBackoff is the time we wait before retrying a failed
+	// delivery for the first time. It doubles with every attempt.
+	webhookInitialBackoff = time.Second
+
+	// webhookMaxBackoff is the max time between two delivery attempts.
+	webhookMaxBackoff = 10 * time.Minute
+
+	// webhookMaxAttempts is the number of delivery attempts after which
+	// we give up on an event until the server is restarted.
+	webhookMaxAttempts = 12
+)
+
+// WebhookEndpoint is a URL that is notified about received payments.
+type WebhookEndpoint struct {
+	// URL is the URL that events are POSTed to.
+	URL string
+
+	// Secret is the key used to sign the events sent to the endpoint.
+	Secret string
+}
+
+// WebhookEvent is the JSON body POSTed to webhook endpoints.
+type WebhookEvent struct {
+	// ID uniquely identifies the event. Receivers should use it to ignore
+	// events that are delivered more than once.
+	ID string `json:"id"`
+
+	// Type is the type of the event.
+	Type string `json:"type"`
+
+	// PaymentHash is the hex encoded payment hash of the invoice.
+	PaymentHash string `json:"paymentHash"`
+
+	// PayRequest is the bech32 encoded invoice.
+	PayRequest string `json:"payRequest"`
+
+	// CallbackID is the id of the LNURL-pay callback that the invoice
+	// was created for.
+	CallbackID string `json:"callbackId"`
+
+	// LightningAddress is the Lightning Address that was paid, if any.
+	LightningAddress string `json:"lightningAddress,omitempty"`
+
+	// AmountMsat is the amount of the invoice.
+	AmountMsat int64 `json:"amountMsat"`
+
+	// AmountPaidMsat is the amount that was paid.
+	AmountPaidMsat int64 `json:"amountPaidMsat"`
+
+	// Comment is the comment left by the payer, if any.
+	Comment string `json:"comment,omitempty"`
+
+	// PayerData is the raw payer data JSON sent by the payer, if any.
+	PayerData string `json:"payerData,omitempty"`
+
+	// SettledAt is the time at which the invoice was settled.
+	SettledAt time.Time `json:"settledAt"`
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of the body keyed with the
+// given secret.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook request body in constant
+// time.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	expected := SignWebhook(secret, body)
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// webhookDelivery is an event that still has to be delivered to an
+// endpoint. It is what we save to disk.
+type webhookDelivery struct {
+	URL   string        `json:"url"`
+	Event *WebhookEvent `json:"event"`
+}
+
+// webhookNotifier delivers events to the configured webhook endpoints. Events
+// are saved to the spool directory until they have been delivered so that
+// they survive restarts.
+type webhookNotifier struct {
+	endpoints map[string]*WebhookEndpoint
+	spoolDir  string
+	client    *http.Client
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxAttempts    int
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newWebhookNotifier creates a notifier for the given endpoints. If spoolDir
+// is empty, undelivered events are only kept in memory.
+func newWebhookNotifier(endpoints []*WebhookEndpoint,
+	spoolDir string) (*webhookNotifier, error) {
+
+	n := &webhookNotifier{
+		endpoints:      make(map[string]*WebhookEndpoint),
+		spoolDir:       spoolDir,
+		client:         &http.Client{Timeout: webhookTimeout},
+		initialBackoff: webhookInitialBackoff,
+		maxBackoff:     webhookMaxBackoff,
+		maxAttempts:    webhookMaxAttempts,
+		quit:           make(chan struct{}),
+	}
+
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid webhook URL '%s'",
+				endpoint.URL)
+		}
+
+		if endpoint.Secret == "" {
+			return nil, fmt.Errorf("webhook %s has no secret",
+				endpoint.URL)
+		}
+
+		n.endpoints[endpoint.URL] = endpoint
+	}
+
+	if spoolDir != "" && len(n.endpoints) > 0 {
+		if err := os.MkdirAll(spoolDir, 0700); err != nil {
+			return nil, fmt.Errorf("could not create webhook spool "+
+				"dir: %w", err)
+		}
+	}
+
+	return n, nil
+}
+
+// Start resumes delivery of the events that were saved to disk.
+func (n *webhookNotifier) Start() error {
+	if n.spoolDir == "" || len(n.endpoints) == 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(n.spoolDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		var d webhookDelivery
+		if err := json.Unmarshal(b, &d); err != nil {
+			log.Printf("Skipping invalid webhook spool file %s: %v",
+				file, err)
+			continue
+		}
+
+		if _, ok := n.endpoints[d.URL]; !ok {
+			log.Printf("Skipping webhook event %s for unknown "+
+				"endpoint %s", d.Event.ID, d.URL)
+			continue
+		}
+
+		n.wg.Add(1)
+		go n.deliver(&d)
+	}
+
+	return nil
+}
+
+// Stop stops all pending deliveries. Events that haven't been delivered yet
+// remain on disk.
+func (n *webhookNotifier) Stop() {
+	close(n.quit)
+	n.wg.Wait()
+}
+
+// Notify saves the event and starts delivering it to all endpoints.
+func (n *webhookNotifier) Notify(event *WebhookEvent) error {
+	for u := range n.endpoints {
+		d := &webhookDelivery{
+			URL:   u,
+			Event: event,
+		}
+		if err := n.spool(d); err != nil {
+			return fmt.Errorf("could not save webhook event: %w",
+				err)
+		}
+
+		n.wg.Add(1)
+		go n.deliver(d)
+	}
+
+	return nil
+}
+
+// deliver POSTs the event to its endpoint, retrying with exponential backoff
+// until it succeeds, we run out of attempts or the notifier is stopped. It
+// must be run as a goroutine.
+func (n *webhookNotifier) deliver(d *webhookDelivery) {
+	defer n.wg.Done()
+
+	backoff := n.initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := n.post(d)
+		if err == nil {
+			if err := n.unspool(d); err != nil {
+				log.Printf("Could not remove delivered webhook "+
+					"event %s: %v", d.Event.ID, err)
+			}
+
+			return
+		}
+
+		if attempt >= n.maxAttempts {
+			log.Printf("Giving up on webhook event %s for %s after "+
+				"%d attempts: %v", d.Event.ID, d.URL, attempt,
+				err)
+			return
+		}
+
+		log.Printf("Webhook event %s for %s failed, retrying in %v: %v",
+			d.Event.ID, d.URL, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-n.quit:
+			return
+		}
+
+		backoff *= 2
+		if backoff > n.maxBackoff {
+			backoff = n.maxBackoff
+		}
+	}
+}
+
+// post makes a single delivery attempt.
+func (n *webhookNotifier) post(d *webhookDelivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-n.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, d.URL, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(
+		WebhookSignatureHeader,
+		SignWebhook(n.endpoints[d.URL].Secret, body),
+	)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// spoolPath returns the file that the delivery is saved to.
+func (n *webhookNotifier) spoolPath(d *webhookDelivery) string {
+	urlHash := sha256.Sum256([]byte(d.URL))
+
+	return filepath.Join(n.spoolDir, fmt.Sprintf(
+		"%s-%x.json", strings.ReplaceAll(d.Event.ID, ".", "-"),
+		urlHash[:8],
+	))
+}
+
+// spool saves the delivery to disk.
+func (n *webhookNotifier) spool(d *webhookDelivery) error {
+	if n.spoolDir == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that we never leave a partially
+	// written event behind.
+	path := n.spoolPath(d)
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// unspool removes a delivered event from disk.
+func (n *webhookNotifier) unspool(d *webhookDelivery) error {
+	if n.spoolDir == "" {
+		return nil
+	}
+
+	err := os.Remove(n.spoolPath(d))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// notifyWebhooks sends a settled event to the webhook endpoints. It is an
+// InvoiceHandler.
+func (s *Server) notifyWebhooks(event *InvoiceEvent) error {
+	inv := event.Invoice
+	if inv.State != InvoiceStateSettled {
+		return nil
+	}
+
+	webhookEvent := &WebhookEvent{
+		ID:             WebhookEventSettled + "." + inv.Hash.String(),
+		Type:           WebhookEventSettled,
+		PaymentHash:    inv.Hash.String(),
+		PayRequest:     inv.PayRequest,
+		CallbackID:     inv.MetadataID,
+		AmountMsat:     inv.AmountMsat,
+		AmountPaidMsat: event.AmountPaidMsat,
+		Comment:        inv.Comment,
+		PayerData:      inv.PayerData,
+		SettledAt:      inv.SettledAt,
+	}
+	if inv.Username != "" {
+		webhookEvent.LightningAddress = s.lnAddressFor(inv.Username)
+	}
+
+	return s.webhooks.Notify(webhookEvent)
+}
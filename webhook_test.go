@@ -0,0 +1,166 @@
+package lndurl
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver is an httptest server that records the events it
+// receives. The given number of failures is returned before requests
+// succeed.
+type webhookReceiver struct {
+	*httptest.Server
+
+	secret   string
+	failures int
+
+	events []*WebhookEvent
+	mu     sync.Mutex
+}
+
+func newWebhookReceiver(t *testing.T, secret string,
+	failures int) *webhookReceiver {
+
+	r := &webhookReceiver{
+		secret:   secret,
+		failures: failures,
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+
+			require.True(t, VerifyWebhook(
+				r.secret, body,
+				req.Header.Get(WebhookSignatureHeader),
+			))
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if r.failures > 0 {
+				r.failures--
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			var event WebhookEvent
+			require.NoError(t, json.Unmarshal(body, &event))
+			r.events = append(r.events, &event)
+		},
+	))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+func (r *webhookReceiver) received() []*WebhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*WebhookEvent(nil), r.events...)
+}
+
+// newTestNotifier creates a notifier that retries quickly.
+func newTestNotifier(t *testing.T, endpoints []*WebhookEndpoint,
+	spoolDir string, maxAttempts int) *webhookNotifier {
+
+	n, err := newWebhookNotifier(endpoints, spoolDir)
+	require.NoError(t, err)
+
+	n.initialBackoff = time.Millisecond
+	n.maxBackoff = 10 * time.Millisecond
+	n.maxAttempts = maxAttempts
+
+	return n
+}
+
+// spooled returns the number of events saved in the spool dir.
+func spooled(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+
+	return len(files)
+}
+
+// TestWebhookDelivery tests that events are signed, retried until they are
+// delivered and removed from disk once delivered.
+func TestWebhookDelivery(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret", 2)
+	spoolDir := t.TempDir()
+
+	n := newTestNotifier(t, []*WebhookEndpoint{{
+		URL:    receiver.URL,
+		Secret: "secret",
+	}}, spoolDir, 5)
+	require.NoError(t, n.Start())
+
+	event := &WebhookEvent{
+		ID:             "invoice.settled.abcd",
+		Type:           WebhookEventSettled,
+		CallbackID:     "abcd",
+		AmountPaidMsat: 1000,
+	}
+	require.NoError(t, n.Notify(event))
+
+	require.Eventually(t, func() bool {
+		return len(receiver.received()) == 1
+	}, time.Second, 10*time.Millisecond)
+	n.Stop()
+
+	require.Equal(t, event.ID, receiver.received()[0].ID)
+	require.Equal(t, event.CallbackID, receiver.received()[0].CallbackID)
+	require.Zero(t, spooled(t, spoolDir))
+}
+
+// TestWebhookSpool tests that undelivered events are kept on disk and
+// delivered once the notifier is restarted.
+func TestWebhookSpool(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret", 2)
+	spoolDir := t.TempDir()
+	endpoints := []*WebhookEndpoint{{
+		URL:    receiver.URL,
+		Secret: "secret",
+	}}
+
+	// Give up after the first failure.
+	n := newTestNotifier(t, endpoints, spoolDir, 1)
+	require.NoError(t, n.Start())
+	require.NoError(t, n.Notify(&WebhookEvent{
+		ID:   "invoice.settled.abcd",
+		Type: WebhookEventSettled,
+	}))
+	n.Stop()
+
+	require.Empty(t, receiver.received())
+	require.Equal(t, 1, spooled(t, spoolDir))
+
+	// After a restart the saved event is delivered.
+	n = newTestNotifier(t, endpoints, spoolDir, 5)
+	require.NoError(t, n.Start())
+
+	require.Eventually(t, func() bool {
+		return len(receiver.received()) == 1
+	}, time.Second, 10*time.Millisecond)
+	n.Stop()
+
+	require.Zero(t, spooled(t, spoolDir))
+}
+
+// TestWebhookSignature tests signing and verifying webhook bodies.
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"id":"abcd"}`)
+	sig := SignWebhook("secret", body)
+
+	require.True(t, VerifyWebhook("secret", body, sig))
+	require.False(t, VerifyWebhook("other", body, sig))
+	require.False(t, VerifyWebhook("secret", []byte(`{}`), sig))
+}
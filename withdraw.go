@@ -0,0 +1,306 @@
+package lndurl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+// NewWithdrawLink creates a new withdraw link that can pay out at most budget
+// millisats (including routing fees) and returns its bech32 encoded LNURL.
+func (s *Server) NewWithdrawLink(budget int64, description string) (string,
+	error) {
+
+	link, err := s.newWithdrawLink(budget, description, false)
+	if err != nil {
+		return "", err
+	}
+
+	return s.withdrawLinkURL(link)
+}
+
+// DefaultWithdrawLink returns the bech32 encoded LNURL of the default withdraw
+// link, or an empty string if no withdraw budget is configured.
+func (s *Server) DefaultWithdrawLink() string {
+	return s.defaultWithdraw
+}
+
+// newWithdrawLink creates a new withdraw link with the given budget and adds
+// it to the store.
+func (s *Server) newWithdrawLink(budget int64, description string,
+	isDefault bool) (*WithdrawLink, error) {
+
+	if budget < s.cfg.MinMsatWithdrawable {
+		return nil, fmt.Errorf("budget of %d msat is less than the "+
+			"minimum withdrawable amount of %d msat", budget,
+			s.cfg.MinMsatWithdrawable)
+	}
+
+	var k1 [32]byte
+	if _, err := rand.Read(k1[:]); err != nil {
+		return nil, err
+	}
+
+	link := &WithdrawLink{
+		K1:          hex.EncodeToString(k1[:]),
+		Description: description,
+		Budget:      budget,
+		Default:     isDefault,
+		CreatedAt:   time.Now(),
+	}
+
+	s.withdrawMu.Lock()
+	defer s.withdrawMu.Unlock()
+
+	if err := s.store.PutWithdrawLink(link); err != nil {
+		return nil, err
+	}
+	s.withdrawLinks[link.K1] = link
+
+	return link, nil
+}
+
+// withdrawLinkURL returns the bech32 encoded LNURL of the given link.
+func (s *Server) withdrawLinkURL(link *WithdrawLink) (string, error) {
+	return EncodeURL(fmt.Sprintf(
+		"%s://%s:%d/withdraw?k1=%s", s.cfg.Protocol, s.cfg.Host,
+		s.cfg.Port, link.K1,
+	))
+}
+
+// withdraw responds with the withdrawRequest for the link identified by the
+// k1 parameter.
+func (s *Server) withdraw(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	k1 := r.Form.Get("k1")
+	if k1 == "" {
+		writeError(w, http.StatusBadRequest, "expected 'k1' field")
+		return
+	}
+
+	s.withdrawMu.Lock()
+	link, ok := s.withdrawLinks[k1]
+	if !ok {
+		s.withdrawMu.Unlock()
+		writeError(w, http.StatusNotFound, "unknown withdraw link")
+		return
+	}
+	maxWithdrawable := s.maxWithdrawable(link)
+	s.withdrawMu.Unlock()
+
+	if maxWithdrawable < s.cfg.MinMsatWithdrawable {
+		writeError(w, http.StatusBadRequest, "withdraw link exhausted")
+		return
+	}
+
+	writeJSON(w, &WithdrawResponse{
+		Tag: TypeWithdrawRequest,
+		Callback: fmt.Sprintf(
+			"%s://%s:%d/withdraw/callback", s.cfg.Protocol,
+			s.cfg.Host, s.cfg.Port,
+		),
+		K1:                 link.K1,
+		DefaultDescription: link.Description,
+		MinWithdrawable:    s.cfg.MinMsatWithdrawable,
+		MaxWithdrawable:    maxWithdrawable,
+	})
+}
+
+// withdrawCallback accepts the invoice created by LN WALLET and, if it is
+// within the bounds of the link's budget, pays it.
+func (s *Server) withdrawCallback(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	k1 := r.Form.Get("k1")
+	if k1 == "" {
+		writeError(w, http.StatusBadRequest, "expected 'k1' field")
+		return
+	}
+
+	pr := r.Form.Get("pr")
+	if pr == "" {
+		writeError(w, http.StatusBadRequest, "expected 'pr' field")
+		return
+	}
+
+	params, err := s.cfg.Network.ChainParams()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// zpay32 accepts invoices of networks whose prefix starts with ours,
+	// so we check the network first.
+	if err := CheckInvoiceNetwork(pr, params); err != nil {
+		writeError(
+			w, http.StatusBadRequest,
+			fmt.Sprintf("invalid invoice: %v", err),
+		)
+		return
+	}
+
+	inv, err := zpay32.Decode(pr, params)
+	if err != nil {
+		writeError(
+			w, http.StatusBadRequest,
+			fmt.Sprintf("invalid invoice: %v", err),
+		)
+		return
+	}
+
+	if inv.MilliSat == nil {
+		writeError(
+			w, http.StatusBadRequest, "invoice must specify an amount",
+		)
+		return
+	}
+	amt := int64(*inv.MilliSat)
+	feeReserve := s.cfg.MaxWithdrawFeeSat * 1000
+
+	if !time.Now().Before(inv.Timestamp.Add(inv.Expiry())) {
+		writeError(w, http.StatusBadRequest, "invoice has expired")
+		return
+	}
+	hash := lntypes.Hash(*inv.PaymentHash)
+
+	// Reserve the amount and the max fee from the link's budget before
+	// we respond so that concurrent requests can't overspend it.
+	s.withdrawMu.Lock()
+	link, ok := s.withdrawLinks[k1]
+	if !ok {
+		s.withdrawMu.Unlock()
+		writeError(w, http.StatusNotFound, "unknown withdraw link")
+		return
+	}
+
+	// A replayed invoice would reserve its amount a second time until
+	// the payment fails as already paid.
+	if _, ok := s.withdrawPayments[hash]; ok {
+		s.withdrawMu.Unlock()
+		writeError(
+			w, http.StatusBadRequest, "invoice already submitted",
+		)
+		return
+	}
+
+	maxWithdrawable := s.maxWithdrawable(link)
+	if amt < s.cfg.MinMsatWithdrawable || amt > maxWithdrawable {
+		s.withdrawMu.Unlock()
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid "+
+			"amount. Expected an amount between %d and %d msat, "+
+			"got %d", s.cfg.MinMsatWithdrawable, maxWithdrawable,
+			amt))
+		return
+	}
+	link.Budget -= amt + feeReserve
+
+	// The reservation is persisted before paying so that a restart
+	// can't restore the budget of an in-flight payment.
+	if err := s.store.PutWithdrawLink(link); err != nil {
+		link.Budget += amt + feeReserve
+		s.withdrawMu.Unlock()
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.withdrawPayments[hash] = struct{}{}
+	s.withdrawMu.Unlock()
+
+	// The spec allows us to respond before the payment completes, so we
+	// pay the invoice in the background.
+	s.wg.Add(1)
+	go s.payWithdrawal(link, pr, hash, amt, feeReserve)
+
+	writeJSON(w, &StatusResponse{Status: StatusOK})
+}
+
+// payWithdrawal pays the given invoice and refunds the link's budget with
+// any unused fee reserve, or with the full reservation if the payment
+// definitely failed, in which case the invoice may be submitted again. If the
+// outcome of the payment is unknown, the reservation is kept as it may still
+// be spent. The payment is abandoned if the server stops. It must be run as a
+// goroutine.
+func (s *Server) payWithdrawal(link *WithdrawLink, pr string,
+	hash lntypes.Hash, amt, feeReserve int64) {
+
+	defer s.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	res, err := s.backend.PayInvoice(ctx, pr, feeReserve)
+
+	var (
+		failed *PaymentFailedError
+		refund int64
+	)
+	switch {
+	case err == nil:
+		refund = feeReserve - res.FeeMsat
+
+	case errors.As(err, &failed):
+		refund = amt + feeReserve
+
+	default:
+		log.Printf("Withdraw payment of %d msat has an unknown "+
+			"outcome, keeping %d msat reserved: %v", amt,
+			amt+feeReserve, err)
+		return
+	}
+
+	s.withdrawMu.Lock()
+	link.Budget += refund
+	if err != nil {
+		delete(s.withdrawPayments, hash)
+	}
+	storeErr := s.store.PutWithdrawLink(link)
+	s.withdrawMu.Unlock()
+
+	if storeErr != nil {
+		log.Printf("Unable to store refund of %d msat to withdraw "+
+			"link: %v", refund, storeErr)
+	}
+
+	if err != nil {
+		log.Printf("Withdraw payment of %d msat failed: %v", amt, err)
+		return
+	}
+
+	log.Printf("Withdraw payment of %d msat succeeded, paid fee: %d msat",
+		amt, res.FeeMsat)
+}
+
+// maxWithdrawable returns the largest amount that can currently be withdrawn
+// using the given link. It must be called with withdrawMu held.
+func (s *Server) maxWithdrawable(link *WithdrawLink) int64 {
+	max := link.Budget - s.cfg.MaxWithdrawFeeSat*1000
+	// A zero max withdrawable amount doesn't cap withdrawals any further.
+	maxAmt := s.cfg.MaxMsatWithdrawable
+	if maxAmt != 0 && maxAmt < max {
+		max = maxAmt
+	}
+
+	return max
+}
@@ -0,0 +1,359 @@
+package lndurl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/stretchr/testify/require"
+)
+
+// withdrawLinkURL decodes the given withdraw LNURL.
+func withdrawLinkURL(t *testing.T, lnurl string) *url.URL {
+	link, err := DecodeURL(lnurl)
+	require.NoError(t, err)
+
+	linkURL, err := url.Parse(link)
+	require.NoError(t, err)
+
+	return linkURL
+}
+
+// payerInvoice creates an invoice for amt msat on a node other than the
+// server's, as LN WALLET would to withdraw to it.
+func payerInvoice(t *testing.T, preimage lntypes.Preimage, amt int64) string {
+	payer, err := NewFakeBackend(&chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+
+	_, pr, err := payer.AddInvoice(context.Background(), &InvoiceRequest{
+		Preimage:   preimage,
+		AmountMsat: amt,
+		Expiry:     time.Hour,
+	})
+	require.NoError(t, err)
+
+	return pr
+}
+
+// expiredInvoice creates a regtest invoice for amt msat that expired an hour
+// ago.
+func expiredInvoice(t *testing.T, amt int64) string {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+
+	inv, err := zpay32.NewInvoice(
+		&chaincfg.RegressionNetParams, lntypes.Hash{9},
+		time.Now().Add(-2*time.Hour),
+		zpay32.Amount(lnwire.MilliSatoshi(amt)),
+		zpay32.Description("expired"), zpay32.Expiry(time.Hour),
+	)
+	require.NoError(t, err)
+
+	pr, err := inv.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return btcec.SignCompact(
+				btcec.S256(), key, chainhash.HashB(msg), true,
+			)
+		},
+	})
+	require.NoError(t, err)
+
+	return pr
+}
+
+// maxWithdrawableOf returns the max withdrawable amount that the given link
+// currently advertises.
+func (ts *testServer) maxWithdrawableOf(t *testing.T,
+	linkURL *url.URL) int64 {
+
+	var withdrawResp WithdrawResponse
+	code := ts.get(t, linkURL.Path, linkURL.Query(), &withdrawResp)
+	require.Equal(t, http.StatusOK, code)
+
+	return withdrawResp.MaxWithdrawable
+}
+
+// TestDefaultWithdrawLink tests that a default withdraw link is created if a
+// withdraw budget is configured.
+func TestDefaultWithdrawLink(t *testing.T) {
+	s := newTestServer(t, nil)
+	require.Empty(t, s.defaultWithdraw)
+
+	s = newTestServer(t, func(cfg *Config) {
+		cfg.WithdrawBudget = 20000
+	})
+	require.NotEmpty(t, s.defaultWithdraw)
+
+	linkURL := withdrawLinkURL(t, s.defaultWithdraw)
+	require.EqualValues(t, 10000, s.maxWithdrawableOf(t, linkURL))
+
+	// Without a max withdrawable amount, only the budget and the fee
+	// reserve limit withdrawals.
+	s = newTestServer(t, func(cfg *Config) {
+		cfg.WithdrawBudget = 20000
+		cfg.MaxMsatWithdrawable = 0
+	})
+	linkURL = withdrawLinkURL(t, s.defaultWithdraw)
+	require.EqualValues(t, 10000, s.maxWithdrawableOf(t, linkURL))
+
+	// A budget that doesn't even cover a single withdrawal is rejected.
+	backend, err := NewFakeBackend(&chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+
+	cfg := *s.cfg
+	cfg.WithdrawBudget = 500
+	_, err = NewServer(&cfg, backend)
+	require.Error(t, err)
+}
+
+// TestWithdrawLinkRestore tests that withdraw links keep their remaining
+// budget when the server is restarted.
+func TestWithdrawLinkRestore(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "lndurl.db")
+	withBudget := func(cfg *Config) {
+		cfg.DBPath = dbPath
+		cfg.WithdrawBudget = 20000
+	}
+
+	s := newTestServer(t, withBudget)
+	linkURL := withdrawLinkURL(t, s.defaultWithdraw)
+
+	var statusResp StatusResponse
+	code := s.get(t, "/withdraw/callback", url.Values{
+		"k1": {linkURL.Query().Get("k1")},
+		"pr": {payerInvoice(t, lntypes.Preimage{1}, 5000)},
+	}, &statusResp)
+	require.Equal(t, http.StatusOK, code)
+
+	// Once paid, the unused fee reserve is refunded.
+	require.Eventually(t, func() bool {
+		return s.maxWithdrawableOf(t, linkURL) == 5000
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, s.Stop())
+
+	// The restarted server hands out the same default link instead of
+	// creating one with the full budget.
+	s = newTestServer(t, withBudget)
+	require.Equal(t, linkURL, withdrawLinkURL(t, s.defaultWithdraw))
+	require.EqualValues(t, 5000, s.maxWithdrawableOf(t, linkURL))
+}
+
+// TestWithdrawErrors tests that invalid withdraw requests and callbacks are
+// rejected.
+func TestWithdrawErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	lnurl, err := s.NewWithdrawLink(20000, "test")
+	require.NoError(t, err)
+	k1 := withdrawLinkURL(t, lnurl).Query().Get("k1")
+
+	tests := []struct {
+		name  string
+		path  string
+		query url.Values
+		code  int
+	}{
+		{
+			name: "missing k1",
+			path: "/withdraw",
+			code: http.StatusBadRequest,
+		},
+		{
+			name:  "unknown k1",
+			path:  "/withdraw",
+			query: url.Values{"k1": {"00"}},
+			code:  http.StatusNotFound,
+		},
+		{
+			name: "callback with unknown k1",
+			path: "/withdraw/callback",
+			query: url.Values{
+				"k1": {"00"},
+				"pr": {payerInvoice(
+					t, lntypes.Preimage{1}, 5000,
+				)},
+			},
+			code: http.StatusNotFound,
+		},
+		{
+			name:  "callback without invoice",
+			path:  "/withdraw/callback",
+			query: url.Values{"k1": {k1}},
+			code:  http.StatusBadRequest,
+		},
+		{
+			name: "invalid invoice",
+			path: "/withdraw/callback",
+			query: url.Values{
+				"k1": {k1},
+				"pr": {"lnbcrt1invalid"},
+			},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "expired invoice",
+			path: "/withdraw/callback",
+			query: url.Values{
+				"k1": {k1},
+				"pr": {expiredInvoice(t, 5000)},
+			},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "amount below min",
+			path: "/withdraw/callback",
+			query: url.Values{
+				"k1": {k1},
+				"pr": {payerInvoice(
+					t, lntypes.Preimage{2}, 500,
+				)},
+			},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "amount above budget",
+			path: "/withdraw/callback",
+			query: url.Values{
+				"k1": {k1},
+				"pr": {payerInvoice(
+					t, lntypes.Preimage{3}, 15000,
+				)},
+			},
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			var errResp Error
+			code := s.get(t, test.path, test.query, &errResp)
+			require.Equal(t, test.code, code)
+			require.Equal(t, StatusError, errResp.Status)
+		})
+	}
+
+	require.Empty(t, s.backend.Payments())
+
+	// Regtest invoices start with the mainnet prefix, but are still
+	// refused on mainnet.
+	s = newTestServer(t, func(cfg *Config) {
+		cfg.Network = lndclient.NetworkMainnet
+	})
+
+	lnurl, err = s.NewWithdrawLink(20000, "test")
+	require.NoError(t, err)
+
+	var errResp Error
+	code := s.get(t, "/withdraw/callback", url.Values{
+		"k1": {withdrawLinkURL(t, lnurl).Query().Get("k1")},
+		"pr": {payerInvoice(t, lntypes.Preimage{4}, 5000)},
+	}, &errResp)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, errResp.Reason, "expected an lnbc invoice")
+}
+
+// TestWithdrawRefund tests that the reservation of a withdrawal is refunded
+// if the payment definitely failed, kept if its outcome is unknown and that
+// the link is exhausted once its budget is spent. Invoices can only be
+// submitted again if their payment failed.
+func TestWithdrawRefund(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	lnurl, err := s.NewWithdrawLink(30000, "test")
+	require.NoError(t, err)
+	linkURL := withdrawLinkURL(t, lnurl)
+	k1 := linkURL.Query().Get("k1")
+
+	submit := func(pr string) int {
+		var resp Error
+		code := s.get(t, "/withdraw/callback", url.Values{
+			"k1": {k1},
+			"pr": {pr},
+		}, &resp)
+
+		return code
+	}
+
+	// A failed payment is refunded in full.
+	s.backend.SetPayResult(0, &PaymentFailedError{
+		Err: errors.New("no route"),
+	})
+	failed := payerInvoice(t, lntypes.Preimage{1}, 5000)
+	require.Equal(t, http.StatusOK, submit(failed))
+	require.Eventually(t, func() bool {
+		return s.maxWithdrawableOf(t, linkURL) == 20000
+	}, time.Second, 10*time.Millisecond)
+
+	// A payment with an unknown outcome may still succeed, so the amount
+	// and the fee reserve stay reserved and the invoice can't be
+	// submitted again.
+	s.backend.SetPayResult(0, errors.New("connection lost"))
+	unknown := payerInvoice(t, lntypes.Preimage{2}, 5000)
+	require.Equal(t, http.StatusOK, submit(unknown))
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 5000, s.maxWithdrawableOf(t, linkURL))
+	require.Equal(t, http.StatusBadRequest, submit(unknown))
+
+	// Once the rest of the budget is spent by retrying the failed
+	// invoice, the link is exhausted.
+	s.backend.SetPayResult(0, nil)
+	require.Equal(t, http.StatusOK, submit(failed))
+	require.Eventually(t, func() bool {
+		var errResp Error
+		code := s.get(t, linkURL.Path, linkURL.Query(), &errResp)
+
+		return code == http.StatusBadRequest &&
+			errResp.Status == StatusError
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestWithdrawStop tests that stopping the server abandons pending withdraw
+// payments and keeps their reservation.
+func TestWithdrawStop(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	lnurl, err := s.NewWithdrawLink(20000, "test")
+	require.NoError(t, err)
+	linkURL := withdrawLinkURL(t, lnurl)
+
+	s.backend.HoldPayments(true)
+
+	var statusResp StatusResponse
+	code := s.get(t, "/withdraw/callback", url.Values{
+		"k1": {linkURL.Query().Get("k1")},
+		"pr": {payerInvoice(t, lntypes.Preimage{1}, 5000)},
+	}, &statusResp)
+	require.Equal(t, http.StatusOK, code)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop()
+	}()
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("server did not stop")
+	}
+
+	s.withdrawMu.Lock()
+	defer s.withdrawMu.Unlock()
+
+	feeReserve := s.cfg.MaxWithdrawFeeSat * 1000
+	link := s.withdrawLinks[linkURL.Query().Get("k1")]
+	require.EqualValues(t, 20000-5000-feeReserve, link.Budget)
+}